@@ -0,0 +1,46 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "crypto/subtle"
+   "net/http"
+   "strings"
+)
+
+// checks for the token or spectator token as a bearer credential
+func authorized(r *http.Request) bool {
+   tok, spectator := tokenSettings()
+   return hasBearer(r, tok) || hasBearer(r, spectator)
+}
+
+// the bearer credential presented, if any
+func bearer(r *http.Request) (string, bool) {
+   return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// checks for a token as the bearer credential; an empty token is never matched
+func hasBearer(r *http.Request, want string) bool {
+   presented, ok := bearer(r)
+   return ok && want != "" && tokenMatches(presented, want)
+}
+
+// compares in constant time, so the time taken doesn't reveal how much of a token was right
+func tokenMatches(presented, want string) bool {
+   return subtle.ConstantTimeCompare([]byte(presented), []byte(want)) == 1
+}
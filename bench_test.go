@@ -0,0 +1,169 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "io"
+   "net"
+   "net/http"
+   "sync"
+   "testing"
+
+   "github.com/gorilla/websocket"
+)
+
+// in-memory listener handing out one end of a pipe per dial
+type pipeListener struct {
+   conns chan net.Conn
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+   return "pipe"
+}
+
+func (pipeAddr) String() string {
+   return "pipe"
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+   c, ok := <-l.conns
+   if !ok {
+      return nil, net.ErrClosed
+   }
+
+   return c, nil
+}
+
+func (l *pipeListener) Close() error {
+   close(l.conns)
+   return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+   return pipeAddr{}
+}
+
+func (l *pipeListener) dial(network, addr string) (net.Conn, error) {
+   client, server := net.Pipe()
+   l.conns <- server
+   return client, nil
+}
+
+// connects n discarding clients directly to the connections list
+func pipeClients(b *testing.B, n int) func() {
+   resetConnections()
+   l := &pipeListener{conns: make(chan net.Conn)}
+   var accepted sync.WaitGroup
+   accepted.Add(n)
+
+   server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      socket, err := upgrader.Upgrade(w, r, nil)
+      if err != nil {
+         b.Error(err)
+         return
+      }
+
+      connMutex.Lock()
+      connections = append(connections, &Connection{socket: socket, mutex: &sync.Mutex{}})
+      connMutex.Unlock()
+      accepted.Done()
+
+      // hold the connection open until the client goes away
+      for {
+         if _, _, err := socket.ReadMessage(); err != nil {
+            return
+         }
+      }
+   })}
+   go server.Serve(l)
+
+   dialer := websocket.Dialer{NetDial: l.dial}
+   var sockets []*websocket.Conn
+
+   for i := 0; i < n; i++ {
+      socket, _, err := dialer.Dial("ws://pipe/", nil)
+      if err != nil {
+         b.Fatal(err)
+      }
+
+      go func() {
+         for {
+            _, r, err := socket.NextReader()
+            if err != nil {
+               return
+            }
+            io.Copy(io.Discard, r)
+         }
+      }()
+
+      sockets = append(sockets, socket)
+   }
+
+   accepted.Wait()
+
+   return func() {
+      for _, socket := range sockets {
+         socket.Close()
+      }
+      server.Close()
+      resetConnections()
+   }
+}
+
+func BenchmarkBroadcastData(b *testing.B) {
+   for _, conns := range []int{1, 8, 64} {
+      for _, columns := range []int{16, 256, 2048} {
+         b.Run(fmt.Sprintf("conns%d/columns%d", conns, columns), func(b *testing.B) {
+            done := pipeClients(b, conns)
+            defer done()
+
+            epochs := testEpochs(columns)
+            b.ResetTimer()
+
+            for i := 0; i < b.N; i++ {
+               // advance time so decimation passes every epoch
+               for _, epoch := range epochs {
+                  epoch[0] += 1e6
+               }
+
+               broadcastData(epochs, nil)
+            }
+         })
+      }
+   }
+}
+
+func BenchmarkEncodeEpochs(b *testing.B) {
+   for _, columns := range []int{16, 256, 2048} {
+      b.Run(fmt.Sprintf("columns%d", columns), func(b *testing.B) {
+         epochs := testEpochs(columns)
+
+         for i := 0; i < b.N; i++ {
+            _, err := json.Marshal(epochs)
+            if err != nil {
+               b.Fatal(err)
+            }
+         }
+      })
+   }
+}
@@ -0,0 +1,109 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "sync"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// longest wait between attempts to reach the collector
+const maxCollectorBackoff = time.Minute
+
+// the delay a close reason from closeRetry asks for
+func retryAfter(err error) (time.Duration, bool) {
+   cerr, ok := err.(*websocket.CloseError)
+   if !ok {
+      return 0, false
+   }
+
+   var secs int
+   _, err = fmt.Sscanf(cerr.Text, "retry-after=%d", &secs)
+   if err != nil {
+      return 0, false
+   }
+
+   return time.Duration(secs) * time.Second, true
+}
+
+// keeps a connection open to the collector, as if it were a client which connected
+func collect(url string) {
+   backoff := time.Second
+
+   for {
+      dialer := websocket.Dialer{
+         Subprotocols: []string{subprotocol},
+         HandshakeTimeout: 10 * time.Second,
+         EnableCompression: *compressLevel > 0,
+      }
+
+      socket, _, err := dialer.Dial(url, nil)
+      if err == nil {
+         start := time.Now()
+         err = push(socket, url)
+
+         // only back off further if connections don't last
+         if time.Since(start) > maxCollectorBackoff {
+            backoff = time.Second
+         }
+      }
+
+      wait := backoff
+      if hint, ok := retryAfter(err); ok && hint > 0 {
+         wait = hint
+      }
+
+      logf("warn", logFields{"collector": url, "error": err.Error()}, "collector %s: %v; retrying in %v", url, err, wait)
+      time.Sleep(wait)
+
+      backoff *= 2
+      if backoff > maxCollectorBackoff {
+         backoff = maxCollectorBackoff
+      }
+   }
+}
+
+// authenticates to the collector, then sends it what a client would receive
+func push(socket *websocket.Conn, url string) error {
+   defer socket.Close()
+
+   tok := *collectorToken
+   if tok == "" {
+      tok = currentToken()
+   }
+
+   err := socket.WriteMessage(websocket.TextMessage, []byte(tok))
+   if err != nil {
+      return err
+   }
+
+   if *compressLevel > 0 {
+      socket.EnableWriteCompression(true)
+      err = socket.SetCompressionLevel(*compressLevel)
+      validate(err)
+   }
+
+   socket.SetReadLimit(*maxRequest)
+
+   // the collector mustn't change what this host's own clients see
+   c := Connection{socket: socket, mutex: &sync.Mutex{}, addr: url, session: newSessionID(), id: newConnID(), spectator: true, maxFailures: *maxWriteFailures}
+   return serve(&c)
+}
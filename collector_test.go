@@ -0,0 +1,86 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "net/http"
+   "net/http/httptest"
+   "strings"
+   "testing"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+func TestRetryAfter(t *testing.T) {
+   err := &websocket.CloseError{Code: websocket.CloseTryAgainLater, Text: "retry-after=30 too many connections"}
+   if wait, ok := retryAfter(err); !ok || wait != 30*time.Second {
+      t.Errorf("got %v, %v", wait, ok)
+   }
+
+   if _, ok := retryAfter(&websocket.CloseError{Text: "bye"}); ok {
+      t.Error("hint found in reason without one")
+   }
+}
+
+func TestPush(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   received := make(chan SignonMessage, 1)
+
+   // a collector which takes the signon then hangs up
+   collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      socket, err := upgrader.Upgrade(w, r, nil)
+      if err != nil {
+         t.Error(err)
+         return
+      }
+      defer socket.Close()
+
+      _, tok, err := socket.ReadMessage()
+      if err != nil || string(tok) != *token {
+         t.Errorf("got token %q, %v", tok, err)
+         return
+      }
+
+      var signon SignonMessage
+      err = socket.ReadJSON(&signon)
+      if err != nil {
+         t.Error(err)
+      }
+
+      received <- signon
+   }))
+   defer collector.Close()
+
+   url := "ws" + strings.TrimPrefix(collector.URL, "http")
+   socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   err = push(socket, url)
+   if err == nil {
+      t.Fatal("push returned without the collector closing")
+   }
+
+   signon := <-received
+   if signon.Host == "" || !signon.Spectator || signon.Tree["fake"] == nil {
+      t.Fatalf("got %+v", signon)
+   }
+}
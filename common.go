@@ -18,11 +18,16 @@
 package main
 
 import (
-   "fmt"
+   "crypto/hmac"
+   "crypto/sha256"
+   "encoding/hex"
+   "errors"
    "os"
    "path"
    "runtime"
-   "syscall"
+   "strings"
+   "sync"
+   "time"
 )
 
 type Event struct {
@@ -30,6 +35,77 @@ type Event struct {
    mnemonic string
    desc     string
    enabled  bool
+   width    uint // counter width in bits
+}
+
+// implemented by sensors whose Enable() baselines newly enabled events itself,
+// without disturbing events already enabled
+type hotEnabler interface {
+   HotEnable() bool
+}
+
+// implemented by sensors which can say why they aren't present; errAbsent means
+// the hardware isn't there, and other errors may be transient
+type prober interface {
+   Probe() error
+}
+
+var errAbsent = errors.New("not present")
+
+// how an event's values are carried in the int64 samples
+type valueType uint8
+
+const (
+   intValue valueType = iota
+   floatValue // fixed point, with floatScale units per 1
+)
+
+const floatScale = 1000
+
+func (t valueType) String() string {
+   if t == floatValue {
+      return "float"
+   }
+
+   return "int"
+}
+
+// implemented by sensors with events whose values are fractional, eg rates
+type valueTyper interface {
+   // type of each event's values, parallel to Events()
+   ValueTypes() []valueType
+}
+
+// type of each event's values, integers unless the sensor says otherwise
+func eventTypes(sensor Sensor) []valueType {
+   if v, ok := sensor.(valueTyper); ok {
+      return v.ValueTypes()
+   }
+
+   return make([]valueType, len(sensor.Events()))
+}
+
+// whether each of a sensor's sampled values is fixed point
+func sensorFloats(sensor Sensor, discrete bool) []bool {
+   n := 1
+   if discrete {
+      n = int(sensor.Sources())
+   }
+
+   types := eventTypes(sensor)
+   var out []bool
+
+   for i, event := range sensor.Events() {
+      if !event.enabled {
+         continue
+      }
+
+      for j := 0; j < n; j++ {
+         out = append(out, types[i] == floatValue)
+      }
+   }
+
+   return out
 }
 
 type Sensor interface {
@@ -41,37 +117,148 @@ type Sensor interface {
    Rate() uint
    // number of hardware elements detected
    Sources() uint
-   // supported events
+   // supported events, always in the same order
    Events() []Event
-   // gets names of enabled events
-   Enable(discrete bool)
+   // applies the enabled events and averaging mode; safe to call repeatedly
+   Enable(discrete bool) error
    // gets names of enabled events
    Headings(mnemonic bool) []string
    // returns samples
    Sample() []int64
+   // applies sensor-specific options, ignoring unknown keys
+   Configure(options map[string]string) error
+   // effective sensor-specific options
+   Config() map[string]string
    // used to prevent hardware access races
    Lock()
    Unlock()
 }
 
 
-// Checks if an error occurred
-func validate(err error) {
+// timestamp units per nanosecond divisor
+func timeUnit() int64 {
+   if *timePrecision == "ns" {
+      return 1
+   }
+
+   return 1e3
+}
+
+// fixed base of monotonic timestamps
+var clockBase = time.Now()
+
+// wall time in the selected precision which monotonic timestamps are relative to,
+// or 0 if timestamps are wall time
+func origin() int64 {
+   if *clock != "monotonic" {
+      return 0
+   }
+
+   return clockBase.UnixNano() / timeUnit()
+}
+
+// current time in the selected precision; monotonic timestamps can't step backwards
+// when the wall clock is adjusted
+func now() int64 {
+   if *clock == "monotonic" {
+      return int64(time.Since(clockBase)) / timeUnit()
+   }
+
+   return time.Now().UnixNano() / timeUnit()
+}
+
+// difference between two counter readings, allowing for the counter wrapping
+func delta(val, last uint64, width uint) uint64 {
+   if width >= 64 {
+      return val - last
+   }
+
+   return (val - last) & (1 << width - 1)
+}
+
+// difference between two readings; when detecting resets, a counter which went back
+// by more than half its range is taken as cleared, returning its new value and true
+func deltaReset(val, last uint64, width uint, detect bool) (uint64, bool) {
+   d := delta(val, last, width)
+
+   half := uint64(1) << (width - 1)
+   if width >= 64 {
+      half = 1 << 63
+   }
+
+   if detect && val < last && d >= half {
+      return val, true
+   }
+
+   return d, false
+}
+
+var (
+   resets     []string // sensors with a counter reset since last taken
+   resetMutex sync.Mutex
+)
+
+func noteReset(sensor string) {
+   resetMutex.Lock()
+   defer resetMutex.Unlock()
+
+   for _, name := range resets {
+      if name == sensor {
+         return
+      }
+   }
+
+   resets = append(resets, sensor)
+}
+
+// returns and clears the sensors which noted a counter reset
+func takeResets() []string {
+   resetMutex.Lock()
+   defer resetMutex.Unlock()
+
+   out := resets
+   resets = nil
+   return out
+}
+
+func hostname() string {
+   name, err := os.Hostname()
    if err != nil {
-      _, file, line, _ := runtime.Caller(1)
-      _, leaf := path.Split(file)
-      fmt.Printf("Failed with '%v' at %v:%v\n", err, leaf, line)
-      os.Exit(1)
+      return "unknown"
    }
+
+   return name
 }
 
-func validateNonblock(err error) {
-   errno, ok := err.(syscall.Errno)
+// keys the hash of the machine ID, so what's sent can't be matched with other applications' IDs
+var machineIDKey = []byte("numascope-5c0e7a9d41b2f836")
 
-   if ok && errno != syscall.EAGAIN {
+// identifies this installation across hostname changes, empty if unknown; as machine-id(5)
+// asks, the ID itself isn't disclosed, but an application-specific hash of it
+func machineID() string {
+   for _, name := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+      content, err := os.ReadFile(name)
+      if err == nil {
+         return appSpecificID(strings.TrimSpace(string(content)))
+      }
+   }
+
+   return ""
+}
+
+func appSpecificID(id string) string {
+   mac := hmac.New(sha256.New, machineIDKey)
+   mac.Write([]byte(id))
+
+   return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Checks if an error occurred
+func validate(err error) {
+   if err != nil {
       _, file, line, _ := runtime.Caller(1)
       _, leaf := path.Split(file)
-      fmt.Printf("Failed with '%v' at %v:%v\n", err, leaf, line)
+      logf("error", logFields{"error": err.Error(), "file": leaf, "line": line}, "Failed with '%v' at %v:%v", err, leaf, line)
       os.Exit(1)
    }
 }
@@ -0,0 +1,106 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "bytes"
+   "compress/flate"
+   "encoding/json"
+   "fmt"
+   "testing"
+)
+
+// a coalesced batch resembling NumaConnect2 per-unit rates
+func testEpochs(columns int) [][]int64 {
+   epochs := make([][]int64, 3)
+   timestamp := int64(1571000000000000)
+
+   for i := range epochs {
+      epochs[i] = []int64{timestamp}
+      timestamp += 256000
+
+      // most counters idle, the rest varying
+      for j := 0; j < columns; j++ {
+         val := int64(0)
+         if j%3 == 0 {
+            val = int64((j*7919+i*104729)%2000000)
+         }
+         epochs[i] = append(epochs[i], val)
+      }
+   }
+
+   return epochs
+}
+
+func BenchmarkCompression(b *testing.B) {
+   raw, err := json.Marshal(testEpochs(11*16))
+   if err != nil {
+      b.Fatal(err)
+   }
+
+   for level := 1; level <= 9; level++ {
+      b.Run(fmt.Sprintf("level%d", level), func(b *testing.B) {
+         var buf bytes.Buffer
+         w, _ := flate.NewWriter(&buf, level)
+         b.SetBytes(int64(len(raw)))
+
+         for i := 0; i < b.N; i++ {
+            buf.Reset()
+            w.Reset(&buf)
+            w.Write(raw)
+            w.Close()
+         }
+
+         b.ReportMetric(float64(len(raw))/float64(buf.Len()), "ratio")
+      })
+   }
+}
+
+// cost of compressing a message the size of a label or heartbeat
+func BenchmarkSmallFrames(b *testing.B) {
+   raw, err := json.Marshal(&HeartbeatMessage{Op: "heartbeat", Timestamp: 1571000000000000, Columns: 176})
+   if err != nil {
+      b.Fatal(err)
+   }
+
+   b.Run("compressed", func(b *testing.B) {
+      var buf bytes.Buffer
+      w, _ := flate.NewWriter(&buf, 3)
+      b.SetBytes(int64(len(raw)))
+
+      for i := 0; i < b.N; i++ {
+         buf.Reset()
+         w.Reset(&buf)
+         w.Write(raw)
+         w.Close()
+      }
+
+      b.ReportMetric(float64(len(raw))/float64(buf.Len()), "ratio")
+   })
+
+   b.Run("uncompressed", func(b *testing.B) {
+      var buf bytes.Buffer
+      b.SetBytes(int64(len(raw)))
+
+      for i := 0; i < b.N; i++ {
+         buf.Reset()
+         buf.Write(raw)
+      }
+   })
+}
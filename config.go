@@ -0,0 +1,418 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "encoding/json"
+   "flag"
+   "fmt"
+   "os"
+   "reflect"
+   rtdebug "runtime/debug"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// settings which can change without restarting
+var reloadable = map[string]bool{
+   "interval":   true,
+   "coalescing": true,
+   "token":      true,
+   "spectator-token": true,
+   "debug":      true,
+   "heartbeat":  true,
+}
+
+// guards the reloadable settings, which SIGHUP changes while other goroutines read them
+var settingsMutex sync.RWMutex
+
+// sample interval in ms
+func intervalSetting() int {
+   settingsMutex.RLock()
+   defer settingsMutex.RUnlock()
+
+   return *interval
+}
+
+// sets the sample interval, raising it to the minimum
+func setIntervalSetting(ms int) {
+   settingsMutex.Lock()
+   defer settingsMutex.Unlock()
+
+   *interval = ms
+   clampInterval()
+}
+
+// coalescing window in us
+func coalescingSetting() int {
+   settingsMutex.RLock()
+   defer settingsMutex.RUnlock()
+
+   return *coalescing
+}
+
+func heartbeatSetting() time.Duration {
+   settingsMutex.RLock()
+   defer settingsMutex.RUnlock()
+
+   return *heartbeatInterval
+}
+
+func currentToken() string {
+   tok, _ := tokenSettings()
+   return tok
+}
+
+// the token and spectator token
+func tokenSettings() (string, string) {
+   settingsMutex.RLock()
+   defer settingsMutex.RUnlock()
+
+   return *token, *spectatorToken
+}
+
+// checks a new value of a reloadable setting as main() does at startup, so a
+// bad file can't apply it
+func checkReloadable(key, val string) error {
+   switch key {
+   case "interval":
+      n, err := strconv.Atoi(val)
+      if err != nil || n <= 0 {
+         return fmt.Errorf("interval must be positive, not '%s'", val)
+      }
+   case "coalescing":
+      n, err := strconv.Atoi(val)
+      if err != nil || n < 0 {
+         return fmt.Errorf("coalescing window can't be negative or '%s'", val)
+      }
+   case "heartbeat":
+      _, err := time.ParseDuration(val)
+      if err != nil {
+         return fmt.Errorf("invalid heartbeat '%s'", val)
+      }
+   case "debug":
+      return (&debugSet{}).Set(val)
+   case "token":
+      if val == "" {
+         return fmt.Errorf("token can't be empty")
+      }
+   }
+
+   return nil
+}
+
+// flags holding credentials, never dumped or sent to clients
+var credentials = map[string]bool{
+   "token":           true,
+   "spectator-token": true,
+   "collector-token": true,
+}
+
+// further flags left out of a dumped config, only meaningful on the command line
+var undumped = map[string]bool{
+   "config":          true,
+   "dump-config":     true,
+   "enable":          true, // included in events
+}
+
+// options for each sensor, keyed by sensor name
+var sensorConfig = map[string]map[string]string{}
+
+// display hints for events, keyed by event mnemonic or description; relayed to
+// clients without interpretation
+var eventHints = map[string]map[string]string{}
+
+// parses an object such as 'sensors' of names to objects of options
+func nestedOptions(filename, field string, val interface{}) (map[string]map[string]string, error) {
+   objects, ok := val.(map[string]interface{})
+   if !ok {
+      return nil, fmt.Errorf("%s: field '%s': expected object", filename, field)
+   }
+
+   out := make(map[string]map[string]string, len(objects))
+
+   for name, opts := range objects {
+      m, ok := opts.(map[string]interface{})
+      if !ok {
+         return nil, fmt.Errorf("%s: field '%s.%s': expected object", filename, field, name)
+      }
+
+      out[name] = make(map[string]string, len(m))
+
+      for key, v := range m {
+         str, err := configValue(v)
+         if err != nil {
+            return nil, fmt.Errorf("%s: field '%s.%s.%s': %v", filename, field, name, key, err)
+         }
+
+         out[name][key] = str
+      }
+   }
+
+   return out, nil
+}
+
+// reads a JSON object whose keys are flag names
+func readConfig(filename string) (map[string]interface{}, error) {
+   content, err := os.ReadFile(filename)
+   if err != nil {
+      return nil, err
+   }
+
+   dec := json.NewDecoder(bytes.NewReader(content))
+   dec.UseNumber()
+
+   var settings map[string]interface{}
+   err = dec.Decode(&settings)
+   if err != nil {
+      return nil, fmt.Errorf("%s is malformed: %v", filename, err)
+   }
+
+   return settings, nil
+}
+
+// converts a JSON value into the string form the flag package parses
+func configValue(val interface{}) (string, error) {
+   switch v := val.(type) {
+   case string:
+      return v, nil
+   case json.Number:
+      return v.String(), nil
+   case bool:
+      return strconv.FormatBool(v), nil
+   case []interface{}:
+      // lists are comma-separated on the command line
+      elems := make([]string, len(v))
+
+      for i, elem := range v {
+         str, ok := elem.(string)
+         if !ok {
+            return "", fmt.Errorf("expected list of strings")
+         }
+         elems[i] = str
+      }
+
+      return strings.Join(elems, ","), nil
+   }
+
+   return "", fmt.Errorf("unsupported type %T", val)
+}
+
+// applies settings to flags not given on the command line; when reloading,
+// only reloadable settings are applied
+func applyConfig(filename string, settings map[string]interface{}, reload bool) error {
+   // informational, from -dump-config
+   delete(settings, "version")
+
+   if val, ok := settings["sensors"]; ok {
+      opts, err := nestedOptions(filename, "sensors", val)
+      if err != nil {
+         return err
+      }
+
+      if !reload {
+         sensorConfig = opts
+      } else if !reflect.DeepEqual(opts, sensorConfig) {
+         logf("warn", logFields{"setting": "sensors"}, "config: restart required to change 'sensors'")
+      }
+
+      delete(settings, "sensors")
+   }
+
+   if val, ok := settings["hints"]; ok {
+      hints, err := nestedOptions(filename, "hints", val)
+      if err != nil {
+         return err
+      }
+
+      if !reload {
+         eventHints = hints
+      } else if !reflect.DeepEqual(hints, eventHints) {
+         logf("warn", logFields{"setting": "hints"}, "config: restart required to change 'hints'")
+      }
+
+      delete(settings, "hints")
+   }
+
+   explicit := make(map[string]bool)
+   flag.Visit(func(f *flag.Flag) {
+      explicit[f.Name] = true
+   })
+
+   // report errors in a stable order
+   keys := make([]string, 0, len(settings))
+   for key := range settings {
+      keys = append(keys, key)
+   }
+   sort.Strings(keys)
+
+   values := make([]string, len(keys))
+
+   // check everything before applying anything
+   for i, key := range keys {
+      f := flag.Lookup(key)
+      if f == nil || key == "config" {
+         return fmt.Errorf("%s: unknown field '%s'", filename, key)
+      }
+
+      var err error
+      values[i], err = configValue(settings[key])
+      if err != nil {
+         return fmt.Errorf("%s: field '%s': %v", filename, key, err)
+      }
+
+      if reload && reloadable[key] && !explicit[key] {
+         err = checkReloadable(key, values[i])
+         if err != nil {
+            return fmt.Errorf("%s: field '%s': %v", filename, key, err)
+         }
+      }
+   }
+
+   // spectators would otherwise have full control
+   tok, spectator := tokenSettings()
+   for i, key := range keys {
+      if explicit[key] || (reload && !reloadable[key]) {
+         continue
+      }
+
+      switch key {
+      case "token":
+         tok = values[i]
+      case "spectator-token":
+         spectator = values[i]
+      }
+   }
+
+   if spectator != "" && spectator == tok {
+      return fmt.Errorf("%s: the spectator token must differ from the token", filename)
+   }
+
+   if reload {
+      settingsMutex.Lock()
+      defer settingsMutex.Unlock()
+   }
+
+   for i, key := range keys {
+      f := flag.Lookup(key)
+      str := values[i]
+
+      if explicit[key] || f.Value.String() == str {
+         continue
+      }
+
+      if reload && !reloadable[key] {
+         logf("warn", logFields{"setting": key}, "config: restart required to change '%s'", key)
+         continue
+      }
+
+      err := f.Value.Set(str)
+      if err != nil {
+         return fmt.Errorf("%s: field '%s': invalid value '%s'", filename, key, str)
+      }
+   }
+
+   if reload {
+      clampInterval()
+   }
+
+   return nil
+}
+
+func loadConfig(filename string) error {
+   settings, err := readConfig(filename)
+   if err != nil {
+      return err
+   }
+
+   return applyConfig(filename, settings, false)
+}
+
+func reloadConfig(filename string) error {
+   settings, err := readConfig(filename)
+   if err != nil {
+      return err
+   }
+
+   return applyConfig(filename, settings, true)
+}
+
+// identifies the build, for tracing where a dumped config came from
+func buildVersion() string {
+   version := "unknown"
+   revision := ""
+
+   if info, ok := rtdebug.ReadBuildInfo(); ok {
+      version = info.Main.Version
+
+      for _, setting := range info.Settings {
+         if setting.Key == "vcs.revision" {
+            revision = " revision " + setting.Value
+         }
+      }
+   }
+
+   return fmt.Sprintf("numascope %s%s, protocol %d", version, revision, protocolVersion)
+}
+
+// the effective settings, sensor options and enabled events, in the form -config reads
+func effectiveConfig() map[string]interface{} {
+   out := map[string]interface{}{"version": buildVersion()}
+
+   settingsMutex.RLock()
+   flag.VisitAll(func(f *flag.Flag) {
+      if !undumped[f.Name] && !credentials[f.Name] {
+         out[f.Name] = f.Value.String()
+      }
+   })
+   settingsMutex.RUnlock()
+
+   enabled := []string{}
+   sensors := make(map[string]map[string]string, len(present))
+
+   for _, sensor := range present {
+      for _, event := range sensor.Events() {
+         if event.enabled {
+            enabled = append(enabled, event.mnemonic)
+         }
+      }
+
+      sensors[sensor.Name()] = sensor.Config()
+   }
+
+   out["events"] = enabled
+   out["sensors"] = sensors
+
+   if len(eventHints) > 0 {
+      out["hints"] = eventHints
+   }
+
+   return out
+}
+
+// prints the effective configuration
+func dumpConfig() {
+   b, err := json.MarshalIndent(effectiveConfig(), "", "   ")
+   validate(err)
+
+   fmt.Println(string(b))
+}
@@ -0,0 +1,178 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+
+   "github.com/gorilla/websocket"
+)
+
+func TestDumpConfig(t *testing.T) {
+   savedEvents, savedConfig := *events, sensorConfig
+   defer func() {
+      *events, sensorConfig = savedEvents, savedConfig
+   }()
+
+   sensor := newFakeSensor()
+   sensor.events[1].enabled = true
+   present = []Sensor{sensor}
+
+   b, err := json.Marshal(effectiveConfig())
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   name := filepath.Join(t.TempDir(), "dumped.json")
+   err = os.WriteFile(name, b, 0644)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // reads back without complaint
+   err = loadConfig(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if *events != "fake1" {
+      t.Fatalf("events %q; want fake1", *events)
+   }
+
+   if _, ok := sensorConfig["fake"]; !ok {
+      t.Fatalf("sensor options %v missing fake", sensorConfig)
+   }
+}
+
+func TestHints(t *testing.T) {
+   saved := eventHints
+   defer func() {
+      eventHints = saved
+   }()
+
+   name := filepath.Join(t.TempDir(), "hints.json")
+   err := os.WriteFile(name, []byte(`{"hints": {"fake0": {"color": "#ff0000"}, "fake event 2": {"group": "x"}}}`), 0644)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   err = loadConfig(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   server := testServer(t, monitor)
+   defer server.Close()
+
+   client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   client.WriteMessage(websocket.TextMessage, []byte(*token))
+
+   var signon SignonMessage
+   err = client.ReadJSON(&signon)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   got := signon.Hints["fake"]
+   if len(got) != 2 || got["fake event 0"]["color"] != "#ff0000" || got["fake event 2"]["group"] != "x" {
+      t.Fatalf("got hints %v", signon.Hints)
+   }
+}
+
+func TestReloadConfig(t *testing.T) {
+   savedInterval, savedCoalescing := *interval, *coalescing
+   defer func() {
+      *interval, *coalescing = savedInterval, savedCoalescing
+   }()
+
+   name := filepath.Join(t.TempDir(), "reload.json")
+   write := func(content string) {
+      err := os.WriteFile(name, []byte(content), 0644)
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+
+   // checked as at startup, applying nothing
+   write(`{"interval": 500, "coalescing": -1}`)
+   if reloadConfig(name) == nil || *interval != savedInterval {
+      t.Fatal("invalid config applied")
+   }
+
+   // while sampling reads them
+   stop := make(chan struct{})
+   done := make(chan struct{})
+   go func() {
+      defer close(done)
+
+      for {
+         select {
+         case <-stop:
+            return
+         default:
+            sampleInterval()
+            flushDue(1, 0)
+         }
+      }
+   }()
+
+   write(`{"interval": 5, "coalescing": 1000}`)
+   err := reloadConfig(name)
+   close(stop)
+   <-done
+
+   if err != nil || *interval != minInterval || *coalescing != 1000 {
+      t.Fatalf("interval %d, coalescing %d, %v", *interval, *coalescing, err)
+   }
+}
+
+func TestConfigOpCredentials(t *testing.T) {
+   saved := *collectorToken
+   *collectorToken = "secret"
+   defer func() {
+      *collectorToken = saved
+   }()
+
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "config"})
+
+   var msg ConfigMessage
+   err := client.ReadJSON(&msg)
+   if err != nil || msg.Op != "config" {
+      t.Fatalf("got %+v, %v", msg, err)
+   }
+
+   for name := range credentials {
+      if _, ok := msg.Settings[name]; ok {
+         t.Errorf("sent credential %s", name)
+      }
+   }
+}
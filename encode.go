@@ -0,0 +1,241 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "strconv"
+   "strings"
+)
+
+// largest integer JavaScript numbers represent exactly
+const maxSafeInteger = 1<<53 - 1
+
+// appends a value rounded to digits significant figures if non-zero, else exactly and
+// if safe, as a string when outside the JavaScript safe range
+func appendValue(buf []byte, val int64, digits int, safe bool) []byte {
+   if digits > 0 {
+      return appendRounded(buf, val, digits)
+   }
+
+   if safe && (val > maxSafeInteger || val < -maxSafeInteger) {
+      buf = append(buf, '"')
+      buf = strconv.AppendInt(buf, val, 10)
+      return append(buf, '"')
+   }
+
+   return strconv.AppendInt(buf, val, 10)
+}
+
+// whether the value at index i of an epoch is fixed point
+func floatAt(floats []bool, i int) bool {
+   return i < len(floats) && floats[i]
+}
+
+// appends a value as appendValue does, unless fixed point, when it's converted back
+// to a decimal
+func appendSample(buf []byte, val int64, float bool, digits int, safe bool) []byte {
+   if !float {
+      return appendValue(buf, val, digits, safe)
+   }
+
+   f := float64(val) / floatScale
+   if digits > 0 {
+      return strconv.AppendFloat(buf, f, 'g', digits, 64)
+   }
+
+   return strconv.AppendFloat(buf, f, 'f', -1, 64)
+}
+
+// appends an epoch as a JSON array; the timestamp is always exact
+func appendEpoch(buf []byte, epoch []int64, floats []bool, digits int, safe bool) []byte {
+   buf = append(buf, '[')
+
+   for j, val := range epoch {
+      if j > 0 {
+         buf = append(buf, ',')
+         buf = appendSample(buf, val, floatAt(floats, j), digits, safe)
+      } else {
+         buf = appendValue(buf, val, 0, safe)
+      }
+   }
+
+   return append(buf, ']')
+}
+
+// epochs which marshal values outside the JavaScript safe range as strings
+type safeEpochs [][]int64
+
+func (e safeEpochs) MarshalJSON() ([]byte, error) {
+   buf := []byte{'['}
+
+   for i, epoch := range e {
+      if i > 0 {
+         buf = append(buf, ',')
+      }
+
+      buf = appendEpoch(buf, epoch, nil, 0, true)
+   }
+
+   return append(buf, ']'), nil
+}
+
+// epochs with values rounded to a number of significant figures, if non-zero, and fixed
+// point values as decimals; timestamps are kept exact
+type roundedEpochs struct {
+   epochs [][]int64
+   digits int
+   safe   bool
+   floats []bool // by index into each epoch
+}
+
+func (e roundedEpochs) MarshalJSON() ([]byte, error) {
+   buf := []byte{'['}
+
+   for i, epoch := range e.epochs {
+      if i > 0 {
+         buf = append(buf, ',')
+      }
+
+      buf = appendEpoch(buf, epoch, e.floats, e.digits, e.safe)
+   }
+
+   return append(buf, ']'), nil
+}
+
+// appends the value rounded to the given significant figures, in whichever form is shorter
+func appendRounded(buf []byte, val int64, digits int) []byte {
+   str := strconv.FormatFloat(float64(val), 'e', digits-1, 64)
+   mantissa, exponent, _ := strings.Cut(str, "e")
+
+   exp, err := strconv.Atoi(exponent)
+   validate(err)
+
+   if strings.Contains(mantissa, ".") {
+      mantissa = strings.TrimRight(strings.TrimRight(mantissa, "0"), ".")
+   }
+
+   short := mantissa
+   if exp != 0 {
+      short += "e" + strconv.Itoa(exp)
+   }
+
+   rounded, err := strconv.ParseFloat(str, 64)
+   validate(err)
+
+   plain := strconv.FormatInt(int64(rounded), 10)
+   if len(short) < len(plain) {
+      return append(buf, short...)
+   }
+
+   return append(buf, plain...)
+}
+
+// epochs with a column for every event in the signon tree, null where disabled
+type fullEpochs struct {
+   epochs [][]int64
+   layout []int // index into each epoch of every column, or -1 if disabled
+   digits int
+   safe   bool
+   floats []bool // by index into each epoch
+}
+
+func (e fullEpochs) MarshalJSON() ([]byte, error) {
+   buf := []byte{'['}
+
+   for i, epoch := range e.epochs {
+      if i > 0 {
+         buf = append(buf, ',')
+      }
+
+      buf = append(buf, '[')
+
+      for j, index := range e.layout {
+         if j > 0 {
+            buf = append(buf, ',')
+         }
+
+         switch {
+         case index < 0 || index >= len(epoch):
+            buf = append(buf, "null"...)
+         case j == 0:
+            buf = appendValue(buf, epoch[index], 0, e.safe)
+         default:
+            buf = appendSample(buf, epoch[index], floatAt(e.floats, index), e.digits, e.safe)
+         }
+      }
+
+      buf = append(buf, ']')
+   }
+
+   return append(buf, ']'), nil
+}
+
+// where a column's values belong in the verbose form
+type verboseColumn struct {
+   sensor string
+   event  string
+   source string // source index, or "all" when summed
+}
+
+// epochs as objects keyed by sensor, event and source, for clients preferring
+// self-describing data over compact arrays
+type verboseEpochs struct {
+   epochs  [][]int64
+   columns []verboseColumn // of each value after the timestamp
+   digits  int
+   safe    bool
+   floats  []bool // by index into each epoch
+}
+
+type verboseEpoch struct {
+   Timestamp json.RawMessage
+   Values    map[string]map[string]map[string]json.RawMessage
+}
+
+func (e verboseEpochs) MarshalJSON() ([]byte, error) {
+   out := make([]verboseEpoch, len(e.epochs))
+
+   for i, epoch := range e.epochs {
+      out[i].Timestamp = appendValue(nil, epoch[0], 0, e.safe)
+      out[i].Values = make(map[string]map[string]map[string]json.RawMessage)
+
+      for j, col := range e.columns {
+         if j+1 >= len(epoch) {
+            break
+         }
+
+         events, ok := out[i].Values[col.sensor]
+         if !ok {
+            events = make(map[string]map[string]json.RawMessage)
+            out[i].Values[col.sensor] = events
+         }
+
+         sources, ok := events[col.event]
+         if !ok {
+            sources = make(map[string]json.RawMessage)
+            events[col.event] = sources
+         }
+
+         sources[col.source] = appendSample(nil, epoch[j+1], floatAt(e.floats, j+1), e.digits, e.safe)
+      }
+   }
+
+   return json.Marshal(out)
+}
@@ -0,0 +1,133 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "testing"
+)
+
+func TestSafeEpochs(t *testing.T) {
+   epochs := safeEpochs{
+      {1571000000000000000, 5, -maxSafeInteger},
+      {1571000000000256000, maxSafeInteger + 1, 0},
+   }
+
+   b, err := json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := `[["1571000000000000000",5,-9007199254740991],["1571000000000256000","9007199254740992",0]]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+}
+
+func TestRoundedEpochs(t *testing.T) {
+   epochs := roundedEpochs{
+      epochs: [][]int64{
+         {1571000000000000000, 123456789, 1234, 5, 0, -987654},
+      },
+      digits: 3,
+      safe: true,
+   }
+
+   b, err := json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := `[["1571000000000000000",1.23e8,1230,5,0,-988000]]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+}
+
+func TestFullEpochs(t *testing.T) {
+   epochs := fullEpochs{
+      epochs: [][]int64{
+         {1571000000000000, 7, 9},
+      },
+      layout: []int{0, -1, 1, -1, 2},
+   }
+
+   b, err := json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := `[[1571000000000000,null,7,null,9]]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+}
+
+func TestVerboseEpochs(t *testing.T) {
+   epochs := verboseEpochs{
+      epochs: [][]int64{
+         {1571000000000000, 7, 9, 3},
+      },
+      columns: []verboseColumn{
+         {"kernel", "pgfault", "0"},
+         {"kernel", "pgfault", "1"},
+         {"kernel", "pgmajfault", "0"},
+      },
+   }
+
+   b, err := json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := `[{"Timestamp":1571000000000000,"Values":{"kernel":{"pgfault":{"0":7,"1":9},"pgmajfault":{"0":3}}}}]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+}
+
+func TestFloatEpochs(t *testing.T) {
+   epochs := roundedEpochs{
+      epochs: [][]int64{
+         {1571000000000000, 1500, 7, 123456},
+      },
+      floats: []bool{false, true, false, true},
+   }
+
+   b, err := json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := `[[1571000000000000,1.5,7,123.456]]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+
+   epochs.digits = 2
+   b, err = json.Marshal(epochs)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want = `[[1571000000000000,1.5,7,1.2e+02]]`
+   if string(b) != want {
+      t.Fatalf("got %s, want %s", b, want)
+   }
+}
@@ -19,12 +19,16 @@ package main
 
 import (
    "fmt"
+   "math"
+   "strconv"
+   "strings"
    "sync"
    "unsafe"
    "golang.org/x/sys/unix"
 )
 
 type Numachip2 struct {
+   id          int // position in the fabric
    regs        *[mapLen / 4]uint32
    stats       *[statsLen / 8]uint64
    last        []uint64
@@ -36,6 +40,7 @@ type Numaconnect2 struct {
    cards    []Numachip2
    discrete bool
    nEnabled int
+   resets   bool // detect counters going back, eg after a hardware clear
    mutex    sync.Mutex
 }
 
@@ -49,163 +54,184 @@ const (
    statCountTotal = 0x3050 / 4
    statCtrl       = 0x3058 / 4
    statCounters   = 0x3100 / 4
-   wrapLimit      = 0xffffffffffff // 48 bits
+   elapsedWidth   = 48
 
    // stats counters
    statElapsed    = 0x000 / 8
 )
 
+// all events are rates, so fractional
+func (d *Numaconnect2) ValueTypes() []valueType {
+   types := make([]valueType, len(d.events))
+   for i := range types {
+      types[i] = floatValue
+   }
+
+   return types
+}
+
 func NewNumaconnect2() *Numaconnect2 {
    return &Numaconnect2{
       events: []Event{
-//         {0x000/8, "n2Cyc", "% cycles", false},
-         {0x008/8, "n2CycRmpeHalf", "% cycles at least half of the available RMPE contexts were in use", false},
-         {0x010/8, "n2CycRmpe0freeS", "% cycles the RMPE had free contexts for SIU accesses", false},
-         {0x030/8, "n2CycRmpe0freeP", "% cycles the RMPE had free contexts for PIU accesses", false},
-         {0x050/8, "n2ReqPiuRmpe", "requests from PIU to RMPE", false},
-         {0x058/8, "n2ValidCycReqPiuRmpe", "% valid cycles acked for requests from PIU to RMPE", false},
-         {0x060/8, "n2WaitCycReqPiuRmpe", "% wait cycles for requests from PIU to RMPE", false},
-         {0x068/8, "n2ResPiuRmpe", "responses from PIU to RMPE", false},
-         {0x070/8, "n2ValidCycResPiuRmpe", "% valid cycles acked for responses from PIU to RMPE", false},
-         {0x078/8, "n2WaitCycResPiuRmpe", "% wait cycles for responses from PIU to RMPE", false},
-         {0x080/8, "n2ReqSiuRmpe", "requests from SIU to RMPE", false},
-         {0x088/8, "n2CycReqSiuRmpe", "% valid cycles acked for requests from SIU to RMPE", false},
-         {0x090/8, "n2WaitCycReqSiuRmpe", "% wait cycles for requests from SIU to RMPE", false},
-         {0x098/8, "n2RespSiuRmpe", "responses from SIU to RMPE", false},
-         {0x0A0/8, "n2ValidCycAckRespSiuRmpe", "% valid cycles acked for responses from SIU to RMPE", false},
-         {0x0A8/8, "n2WaitCycRespSiuRmpe", "% wait cycles for responses from SIU to RMPE", false},
-
-         {0x0B0/8, "n2CycHalfLmpeUsed", "% cycles at least half of the available LMPE contexts were in use", false},
-         {0x0B8/8, "n2CycLmpeFreePiu", "% cycles the LMPE had free contexts for SIU accesses", false},
-         {0x0D8/8, "n2CycLmpeFreeSiu", "% cycles the LMPE had free contexts for PIU accesses", false},
-         {0x0F8/8, "n2ReqPiuLmpe", "requests from PIU to LMPE", false},
-         {0x100/8, "n2WaitcycReqPiuLmpe", "% wait cycles for requests from PIU to LMPE", false},
-         {0x108/8, "n2RespPiuLmpe", "responses from PIU to LMPE", false},
-         {0x110/8, "n2ValidCycResPiuLmpe", "% valid cycles acked for responses from PIU to LMPE", false},
-         {0x118/8, "n2WaitCycRespPiuLmpe", "% wait cycles for responses from PIU to LMPE", false},
-         {0x120/8, "n2ReqSiuLmpe", "requests from SIU to LMPE", false},
-         {0x128/8, "n2ValidCycAckReqSiuLmpe", "% valid cycles acked for requests from SIU to LMPE", false},
-         {0x130/8, "n2WaitCycReqSiuLmpe", "% wait cycles for requests from SIU to LMPE", false},
-         {0x138/8, "n2RespSiuLmpe", "responses from SIU to LMPE", false},
-         {0x140/8, "n2ValidCycAckRespSiuLmpe", "% valid cycles acked for responses from SIU to LMPE", false},
-         {0x148/8, "n2WaitCycRespSiuLmpe", "% wait cycles for responses from SIU to LMPE", false},
-
-         {0x210/8, "n2VicBlkXRecv", "VicBlk and VicBlkClean commands received", false},
-         {0x218/8, "n2RdBlkXRecv", "RdBlk and RdBlkS commands received", false},
-         {0x220/8, "n2RdBlkModRecv", "RdBlkMod commands received", false},
-         {0x228/8, "n2ChangeToDirtyRecv", "ChangeToDirty commands received", false},
-         {0x230/8, "n2RdSizedRecv", "RdSized commands received", false},
-         {0x238/8, "n2WrSizedRecv", "WrSized commands received", false},
-         {0x240/8, "n2DirPrbRecv", "directed Probe commands received", false},
-         {0x248/8, "n2BcastPrbRecv", "broadcast Probe commands received", false},
-         {0x250/8, "n2BcastCmdRecv", "Broadcast commands received", false},
-         {0x258/8, "n2RdRespCmdRecv", "RdResponse commands received", false},
-         {0x260/8, "n2PrbRespCmdRecv", "ProbeResponse commands received", false},
-         {0x268/8, "n2CachelinesRecv", "data packets with full cachelines of data received", false},
-         {0x270/8, "n2PartCachelinesRecv", "data packets with less than a full cache line received", false},
-
-         {0x278/8, "n2VicBlkXSent", "VicBlk and VicBlkClean commands sent", false},
-         {0x280/8, "n2RdBlkXSent", "RdBlk and RdBlkS commands sent", false},
-         {0x288/8, "n2RdBlkModSent", "RdBlkMod commands sent", false},
-         {0x290/8, "n2ChangeToDirtySent", "ChangeToDirty commands sent", false},
-         {0x298/8, "n2RdSizedSent", "RdSized commands sent", false},
-         {0x2A0/8, "n2WrSizedSent", "WrSized commands sent", false},
-         {0x2A8/8, "n2BcastProbeCmdSent", "broadcast Probe commands sent", false},
-         {0x2B0/8, "n2BcastCmdSent", "broadcast commands sent", false},
-         {0x2B8/8, "n2RdRespSent", "RdResponse commands sent", false},
-         {0x2C0/8, "n2ProbeRespSent", "ProbeResponse commands sent", false},
-         {0x2C8/8, "n2CachelinesSent", "data packets with full cachelines of data sent", false},
-         {0x2D0/8, "n2LessCachelinesSent", "data packets with less than a full cache line sent", false},
-
-         {0x2D8/8, "n2CacheReadHitRmpe", "nCache read hits on RMPE", false},
-         {0x2E0/8, "n2CacheStoreHitRmpe", "nCache store hits on RMPE", false},
-         {0x2E8/8, "n2CacheStoreMissRmpe", "nCache store misses on RMPE", false},
-         {0x2F0/8, "n2CacheRolloutRmpe", "nCache roll outs on RMPE", false},
-         {0x2F8/8, "n2CacheInvalidatesRmpe", "nCache invalidates on RMPE", false},
-
-         {0x378/8, "n2CycOneFreeHreqPiu", "% cycles with at least one free Hreq context in PIU", false},
-         {0x380/8, "n2CycOneFreePprb", "% cycles with at least one free Pprb context in PIU", false},
-         {0x388/8, "n2CycOneFreeHprb", "% cycles with at least one free Hprb context in PIU", false},
-         {0x390/8, "n2CycOneFreePreq", "% cycles with at least one free Preq context in PIU", false},
-
-         {0x398/8, "n2CacheTag0Accesses", "accesses to Ctag cache 0", false},
-         {0x3A0/8, "n2CacheTag0WriteHit", "write hit accesses to Ctag cache 0", false},
-         {0x3A8/8, "n2CacheTag0ReadHit", "read hit accesses to Ctag cache 0", false},
-         {0x3B0/8, "n2CacheTag0WriteWriteback", "write accesses with writebacks to Ctag cache 0", false},
-         {0x3B8/8, "n2CacheTag0ReadWriteback", "read accesses with writebacks to Ctag cache 0", false},
-         {0x3C0/8, "n2CacheTag0WriteMiss", "write miss accesses to Ctag cache 0", false},
-         {0x3C8/8, "n2CacheTag0ReadMiss", "read miss accesses to Ctag cache 0", false},
-
-         {0x3D0/8, "n2CacheTag1Accesses", "accesses to Ctag cache 1", false},
-         {0x3D8/8, "n2CacheTag1WriteHit", "write hit accesses to Ctag cache 1", false},
-         {0x3E0/8, "n2CacheTag1ReadHit", "read hit accesses to Ctag cache 1", false},
-         {0x3E8/8, "n2CacheTag1WriteWriteback", "write accesses with writebacks to Ctag cache 1", false},
-         {0x3F0/8, "n2CacheTag1ReadWriteback", "read accesses with writebacks to Ctag cache 1", false},
-         {0x3F8/8, "n2CacheTag1WriteMiss", "write miss accesses to Ctag cache 1", false},
-         {0x400/8, "n2CacheTag1ReadMiss", "read miss accesses to Ctag cache 1", false},
-
-         {0x408/8, "n2CacheTag2Accesses", "accesses to Ctag cache 2", false},
-         {0x410/8, "n2CacheTag2WriteHit", "write hit accesses to Ctag cache 2", false},
-         {0x418/8, "n2CacheTag2ReadHit", "read hit accesses to Ctag cache 2", false},
-         {0x420/8, "n2CacheTag2WriteWriteback", "write accesses with writebacks to Ctag cache 2", false},
-         {0x428/8, "n2CacheTag2ReadWriteback", "read accesses with writebacks to Ctag cache 2", false},
-         {0x430/8, "n2CacheTag2WriteMiss", "write miss accesses to Ctag cache 2", false},
-         {0x438/8, "n2CacheTag2ReadMiss", "read miss accesses to Ctag cache 2", false},
-
-         {0x440/8, "n2CacheTag3Accesses", "accesses to Ctag cache 3", false},
-         {0x448/8, "n2CacheTag3WriteHit", "write hit accesses to Ctag cache 3", false},
-         {0x450/8, "n2CacheTag3ReadHit", "read hit accesses to Ctag cache 3", false},
-         {0x458/8, "n2CacheTag3WriteWriteback", "write accesses with writebacks to Ctag cache 3", false},
-         {0x460/8, "n2CacheTag3ReadWriteback", "read accesses with writebacks to Ctag cache 3", false},
-         {0x468/8, "n2CacheTag3WriteMiss", "write miss accesses to Ctag cache 3", false},
-         {0x470/8, "n2CacheTag3ReadMiss", "read miss accesses to Ctag cache 3", false},
-
-         {0x478/8, "n2MainTag0Access", "accesses to Mtag cache 0", false},
-         {0x480/8, "n2MainTag0WriteHit", "write hit accesses to Mtag cache 0", false},
-         {0x488/8, "n2MainTag0ReadHit", "read hit accesses to Mtag cache 0", false},
-         {0x490/8, "n2MainTag0WriteWriteback", "write accesses with writebacks to Mtag cache 0", false},
-         {0x498/8, "n2MainTag0ReadWriteback", "read accesses with writebacks to Mtag cache 0", false},
-         {0x4A0/8, "n2MainTag0WriteMiss", "write miss accesses to Mtag cache 0", false},
-         {0x4A8/8, "n2MainTag0ReadMiss", "read miss accesses to Mtag cache 0", false},
-
-         {0x4B0/8, "n2MainTag1Access", "accesses to Mtag cache 1", false},
-         {0x4B8/8, "n2MainTag1WriteHit", "write hit accesses to Mtag cache 1", false},
-         {0x4C0/8, "n2MainTag1ReadHit", "read hit accesses to Mtag cache 1", false},
-         {0x4C8/8, "n2MainTag1WriteWriteback", "write accesses with writebacks to Mtag cache 1", false},
-         {0x4D0/8, "n2MainTag1ReadWriteback", "read accesses with writebacks to Mtag cache 1", false},
-         {0x4D8/8, "n2MainTag1WriteMiss", "write miss accesses to Mtag cache 1", false},
-         {0x4E0/8, "n2MainTag1ReadMiss", "read miss accesses to Mtag cache 1", false},
-
-         {0x4E8/8, "n2MainTag2Access", "accesses to Mtag cache 2", false},
-         {0x4F0/8, "n2MainTag2WriteHit", "write hit accesses to Mtag cache 2", false},
-         {0x4F8/8, "n2MainTag2ReadHit", "read hit accesses to Mtag cache 2", false},
-         {0x500/8, "n2MainTag2WriteWriteback", "write accesses with writebacks to Mtag cache 2", false},
-         {0x508/8, "n2MainTag2ReadWriteback", "read accesses with writebacks to Mtag cache 2", false},
-         {0x510/8, "n2MainTag2WriteMiss", "write miss accesses to Mtag cache 2", false},
-         {0x518/8, "n2MainTag2ReadMiss", "read miss accesses to Mtag cache 2", false},
-
-         {0x520/8, "n2MainTag3Access", "accesses to Mtag cache 3", false},
-         {0x528/8, "n2MainTag3WriteHit", "write hit accesses to Mtag cache 3", false},
-         {0x530/8, "n2MainTag3ReadHit", "read hit accesses to Mtag cache 3", false},
-         {0x538/8, "n2MainTag3WriteAccess", "write accesses with writebacks to Mtag cache 3", false},
-         {0x540/8, "n2MainTag3ReadAccess", "read accesses with writebacks to Mtag cache 3", false},
-         {0x548/8, "n2MainTag3WriteMiss", "write miss accesses to Mtag cache 3", false},
-         {0x550/8, "n2MainTag3ReadMiss", "read miss accesses to Mtag cache 3", false},
+//         {0x000/8, "n2Cyc", "% cycles", false, 48},
+         {0x008/8, "n2CycRmpeHalf", "% cycles at least half of the available RMPE contexts were in use", false, 48},
+         {0x010/8, "n2CycRmpe0freeS", "% cycles the RMPE had free contexts for SIU accesses", false, 48},
+         {0x030/8, "n2CycRmpe0freeP", "% cycles the RMPE had free contexts for PIU accesses", false, 48},
+         {0x050/8, "n2ReqPiuRmpe", "requests from PIU to RMPE", false, 48},
+         {0x058/8, "n2ValidCycReqPiuRmpe", "% valid cycles acked for requests from PIU to RMPE", false, 48},
+         {0x060/8, "n2WaitCycReqPiuRmpe", "% wait cycles for requests from PIU to RMPE", false, 48},
+         {0x068/8, "n2ResPiuRmpe", "responses from PIU to RMPE", false, 48},
+         {0x070/8, "n2ValidCycResPiuRmpe", "% valid cycles acked for responses from PIU to RMPE", false, 48},
+         {0x078/8, "n2WaitCycResPiuRmpe", "% wait cycles for responses from PIU to RMPE", false, 48},
+         {0x080/8, "n2ReqSiuRmpe", "requests from SIU to RMPE", false, 48},
+         {0x088/8, "n2CycReqSiuRmpe", "% valid cycles acked for requests from SIU to RMPE", false, 48},
+         {0x090/8, "n2WaitCycReqSiuRmpe", "% wait cycles for requests from SIU to RMPE", false, 48},
+         {0x098/8, "n2RespSiuRmpe", "responses from SIU to RMPE", false, 48},
+         {0x0A0/8, "n2ValidCycAckRespSiuRmpe", "% valid cycles acked for responses from SIU to RMPE", false, 48},
+         {0x0A8/8, "n2WaitCycRespSiuRmpe", "% wait cycles for responses from SIU to RMPE", false, 48},
+
+         {0x0B0/8, "n2CycHalfLmpeUsed", "% cycles at least half of the available LMPE contexts were in use", false, 48},
+         {0x0B8/8, "n2CycLmpeFreePiu", "% cycles the LMPE had free contexts for SIU accesses", false, 48},
+         {0x0D8/8, "n2CycLmpeFreeSiu", "% cycles the LMPE had free contexts for PIU accesses", false, 48},
+         {0x0F8/8, "n2ReqPiuLmpe", "requests from PIU to LMPE", false, 48},
+         {0x100/8, "n2WaitcycReqPiuLmpe", "% wait cycles for requests from PIU to LMPE", false, 48},
+         {0x108/8, "n2RespPiuLmpe", "responses from PIU to LMPE", false, 48},
+         {0x110/8, "n2ValidCycResPiuLmpe", "% valid cycles acked for responses from PIU to LMPE", false, 48},
+         {0x118/8, "n2WaitCycRespPiuLmpe", "% wait cycles for responses from PIU to LMPE", false, 48},
+         {0x120/8, "n2ReqSiuLmpe", "requests from SIU to LMPE", false, 48},
+         {0x128/8, "n2ValidCycAckReqSiuLmpe", "% valid cycles acked for requests from SIU to LMPE", false, 48},
+         {0x130/8, "n2WaitCycReqSiuLmpe", "% wait cycles for requests from SIU to LMPE", false, 48},
+         {0x138/8, "n2RespSiuLmpe", "responses from SIU to LMPE", false, 48},
+         {0x140/8, "n2ValidCycAckRespSiuLmpe", "% valid cycles acked for responses from SIU to LMPE", false, 48},
+         {0x148/8, "n2WaitCycRespSiuLmpe", "% wait cycles for responses from SIU to LMPE", false, 48},
+
+         {0x210/8, "n2VicBlkXRecv", "VicBlk and VicBlkClean commands received", false, 48},
+         {0x218/8, "n2RdBlkXRecv", "RdBlk and RdBlkS commands received", false, 48},
+         {0x220/8, "n2RdBlkModRecv", "RdBlkMod commands received", false, 48},
+         {0x228/8, "n2ChangeToDirtyRecv", "ChangeToDirty commands received", false, 48},
+         {0x230/8, "n2RdSizedRecv", "RdSized commands received", false, 48},
+         {0x238/8, "n2WrSizedRecv", "WrSized commands received", false, 48},
+         {0x240/8, "n2DirPrbRecv", "directed Probe commands received", false, 48},
+         {0x248/8, "n2BcastPrbRecv", "broadcast Probe commands received", false, 48},
+         {0x250/8, "n2BcastCmdRecv", "Broadcast commands received", false, 48},
+         {0x258/8, "n2RdRespCmdRecv", "RdResponse commands received", false, 48},
+         {0x260/8, "n2PrbRespCmdRecv", "ProbeResponse commands received", false, 48},
+         {0x268/8, "n2CachelinesRecv", "data packets with full cachelines of data received", false, 48},
+         {0x270/8, "n2PartCachelinesRecv", "data packets with less than a full cache line received", false, 48},
+
+         {0x278/8, "n2VicBlkXSent", "VicBlk and VicBlkClean commands sent", false, 48},
+         {0x280/8, "n2RdBlkXSent", "RdBlk and RdBlkS commands sent", false, 48},
+         {0x288/8, "n2RdBlkModSent", "RdBlkMod commands sent", false, 48},
+         {0x290/8, "n2ChangeToDirtySent", "ChangeToDirty commands sent", false, 48},
+         {0x298/8, "n2RdSizedSent", "RdSized commands sent", false, 48},
+         {0x2A0/8, "n2WrSizedSent", "WrSized commands sent", false, 48},
+         {0x2A8/8, "n2BcastProbeCmdSent", "broadcast Probe commands sent", false, 48},
+         {0x2B0/8, "n2BcastCmdSent", "broadcast commands sent", false, 48},
+         {0x2B8/8, "n2RdRespSent", "RdResponse commands sent", false, 48},
+         {0x2C0/8, "n2ProbeRespSent", "ProbeResponse commands sent", false, 48},
+         {0x2C8/8, "n2CachelinesSent", "data packets with full cachelines of data sent", false, 48},
+         {0x2D0/8, "n2LessCachelinesSent", "data packets with less than a full cache line sent", false, 48},
+
+         {0x2D8/8, "n2CacheReadHitRmpe", "nCache read hits on RMPE", false, 48},
+         {0x2E0/8, "n2CacheStoreHitRmpe", "nCache store hits on RMPE", false, 48},
+         {0x2E8/8, "n2CacheStoreMissRmpe", "nCache store misses on RMPE", false, 48},
+         {0x2F0/8, "n2CacheRolloutRmpe", "nCache roll outs on RMPE", false, 48},
+         {0x2F8/8, "n2CacheInvalidatesRmpe", "nCache invalidates on RMPE", false, 48},
+
+         {0x378/8, "n2CycOneFreeHreqPiu", "% cycles with at least one free Hreq context in PIU", false, 48},
+         {0x380/8, "n2CycOneFreePprb", "% cycles with at least one free Pprb context in PIU", false, 48},
+         {0x388/8, "n2CycOneFreeHprb", "% cycles with at least one free Hprb context in PIU", false, 48},
+         {0x390/8, "n2CycOneFreePreq", "% cycles with at least one free Preq context in PIU", false, 48},
+
+         {0x398/8, "n2CacheTag0Accesses", "accesses to Ctag cache 0", false, 48},
+         {0x3A0/8, "n2CacheTag0WriteHit", "write hit accesses to Ctag cache 0", false, 48},
+         {0x3A8/8, "n2CacheTag0ReadHit", "read hit accesses to Ctag cache 0", false, 48},
+         {0x3B0/8, "n2CacheTag0WriteWriteback", "write accesses with writebacks to Ctag cache 0", false, 48},
+         {0x3B8/8, "n2CacheTag0ReadWriteback", "read accesses with writebacks to Ctag cache 0", false, 48},
+         {0x3C0/8, "n2CacheTag0WriteMiss", "write miss accesses to Ctag cache 0", false, 48},
+         {0x3C8/8, "n2CacheTag0ReadMiss", "read miss accesses to Ctag cache 0", false, 48},
+
+         {0x3D0/8, "n2CacheTag1Accesses", "accesses to Ctag cache 1", false, 48},
+         {0x3D8/8, "n2CacheTag1WriteHit", "write hit accesses to Ctag cache 1", false, 48},
+         {0x3E0/8, "n2CacheTag1ReadHit", "read hit accesses to Ctag cache 1", false, 48},
+         {0x3E8/8, "n2CacheTag1WriteWriteback", "write accesses with writebacks to Ctag cache 1", false, 48},
+         {0x3F0/8, "n2CacheTag1ReadWriteback", "read accesses with writebacks to Ctag cache 1", false, 48},
+         {0x3F8/8, "n2CacheTag1WriteMiss", "write miss accesses to Ctag cache 1", false, 48},
+         {0x400/8, "n2CacheTag1ReadMiss", "read miss accesses to Ctag cache 1", false, 48},
+
+         {0x408/8, "n2CacheTag2Accesses", "accesses to Ctag cache 2", false, 48},
+         {0x410/8, "n2CacheTag2WriteHit", "write hit accesses to Ctag cache 2", false, 48},
+         {0x418/8, "n2CacheTag2ReadHit", "read hit accesses to Ctag cache 2", false, 48},
+         {0x420/8, "n2CacheTag2WriteWriteback", "write accesses with writebacks to Ctag cache 2", false, 48},
+         {0x428/8, "n2CacheTag2ReadWriteback", "read accesses with writebacks to Ctag cache 2", false, 48},
+         {0x430/8, "n2CacheTag2WriteMiss", "write miss accesses to Ctag cache 2", false, 48},
+         {0x438/8, "n2CacheTag2ReadMiss", "read miss accesses to Ctag cache 2", false, 48},
+
+         {0x440/8, "n2CacheTag3Accesses", "accesses to Ctag cache 3", false, 48},
+         {0x448/8, "n2CacheTag3WriteHit", "write hit accesses to Ctag cache 3", false, 48},
+         {0x450/8, "n2CacheTag3ReadHit", "read hit accesses to Ctag cache 3", false, 48},
+         {0x458/8, "n2CacheTag3WriteWriteback", "write accesses with writebacks to Ctag cache 3", false, 48},
+         {0x460/8, "n2CacheTag3ReadWriteback", "read accesses with writebacks to Ctag cache 3", false, 48},
+         {0x468/8, "n2CacheTag3WriteMiss", "write miss accesses to Ctag cache 3", false, 48},
+         {0x470/8, "n2CacheTag3ReadMiss", "read miss accesses to Ctag cache 3", false, 48},
+
+         {0x478/8, "n2MainTag0Access", "accesses to Mtag cache 0", false, 48},
+         {0x480/8, "n2MainTag0WriteHit", "write hit accesses to Mtag cache 0", false, 48},
+         {0x488/8, "n2MainTag0ReadHit", "read hit accesses to Mtag cache 0", false, 48},
+         {0x490/8, "n2MainTag0WriteWriteback", "write accesses with writebacks to Mtag cache 0", false, 48},
+         {0x498/8, "n2MainTag0ReadWriteback", "read accesses with writebacks to Mtag cache 0", false, 48},
+         {0x4A0/8, "n2MainTag0WriteMiss", "write miss accesses to Mtag cache 0", false, 48},
+         {0x4A8/8, "n2MainTag0ReadMiss", "read miss accesses to Mtag cache 0", false, 48},
+
+         {0x4B0/8, "n2MainTag1Access", "accesses to Mtag cache 1", false, 48},
+         {0x4B8/8, "n2MainTag1WriteHit", "write hit accesses to Mtag cache 1", false, 48},
+         {0x4C0/8, "n2MainTag1ReadHit", "read hit accesses to Mtag cache 1", false, 48},
+         {0x4C8/8, "n2MainTag1WriteWriteback", "write accesses with writebacks to Mtag cache 1", false, 48},
+         {0x4D0/8, "n2MainTag1ReadWriteback", "read accesses with writebacks to Mtag cache 1", false, 48},
+         {0x4D8/8, "n2MainTag1WriteMiss", "write miss accesses to Mtag cache 1", false, 48},
+         {0x4E0/8, "n2MainTag1ReadMiss", "read miss accesses to Mtag cache 1", false, 48},
+
+         {0x4E8/8, "n2MainTag2Access", "accesses to Mtag cache 2", false, 48},
+         {0x4F0/8, "n2MainTag2WriteHit", "write hit accesses to Mtag cache 2", false, 48},
+         {0x4F8/8, "n2MainTag2ReadHit", "read hit accesses to Mtag cache 2", false, 48},
+         {0x500/8, "n2MainTag2WriteWriteback", "write accesses with writebacks to Mtag cache 2", false, 48},
+         {0x508/8, "n2MainTag2ReadWriteback", "read accesses with writebacks to Mtag cache 2", false, 48},
+         {0x510/8, "n2MainTag2WriteMiss", "write miss accesses to Mtag cache 2", false, 48},
+         {0x518/8, "n2MainTag2ReadMiss", "read miss accesses to Mtag cache 2", false, 48},
+
+         {0x520/8, "n2MainTag3Access", "accesses to Mtag cache 3", false, 48},
+         {0x528/8, "n2MainTag3WriteHit", "write hit accesses to Mtag cache 3", false, 48},
+         {0x530/8, "n2MainTag3ReadHit", "read hit accesses to Mtag cache 3", false, 48},
+         {0x538/8, "n2MainTag3WriteAccess", "write accesses with writebacks to Mtag cache 3", false, 48},
+         {0x540/8, "n2MainTag3ReadAccess", "read accesses with writebacks to Mtag cache 3", false, 48},
+         {0x548/8, "n2MainTag3WriteMiss", "write miss accesses to Mtag cache 3", false, 48},
+         {0x550/8, "n2MainTag3ReadMiss", "read miss accesses to Mtag cache 3", false, 48},
       },
+      resets: true,
    }
 }
 
 func (d *Numaconnect2) Present() bool {
+   return d.Probe() == nil
+}
+
+func (d *Numaconnect2) Probe() error {
    fd, err := unix.Open("/dev/mem", unix.O_RDWR, 0)
-   validate(err)
+   if err != nil {
+      return fmt.Errorf("opening /dev/mem: %v", err)
+   }
 
    data, err := unix.Mmap(fd, mapBase, mapLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_FILE)
-   validate(err)
+   if err != nil {
+      unix.Close(fd)
+      return fmt.Errorf("mapping registers: %v", err)
+   }
    defer unix.Munmap(data)
 
    regs := (*[mapLen/4]uint32)(unsafe.Pointer(&data[0]))
    if regs[venDev] != venDevId {
-      return false
+      unix.Close(fd)
+      return errAbsent
    }
 
    master := (regs[info+5] >> 4) & 0xfff
@@ -224,12 +250,53 @@ func (d *Numaconnect2) Present() bool {
       }
 
       stats := (*[statsLen / 8]uint64)(unsafe.Pointer(&regs[statCounters]))
-      d.cards = append(d.cards, Numachip2{regs: regs, stats: stats})
+      d.cards = append(d.cards, Numachip2{id: len(d.cards), regs: regs, stats: stats})
 
       pos = regs[info+6] & 0xfff
    }
 
-   return true
+   return nil
+}
+
+// 'cards' restricts sampling to a comma-separated list of card positions
+func (d *Numaconnect2) Configure(options map[string]string) error {
+   if val, ok := options["resets"]; ok {
+      resets, err := strconv.ParseBool(val)
+      if err != nil {
+         return fmt.Errorf("invalid resets '%s'", val)
+      }
+
+      d.resets = resets
+   }
+
+   list, ok := options["cards"]
+   if !ok {
+      return nil
+   }
+
+   var cards []Numachip2
+
+   for _, elem := range strings.Split(list, ",") {
+      id, err := strconv.Atoi(strings.TrimSpace(elem))
+      if err != nil || id < 0 || id >= len(d.cards) {
+         return fmt.Errorf("invalid card '%s'", elem)
+      }
+
+      cards = append(cards, d.cards[id])
+   }
+
+   d.cards = cards
+   return nil
+}
+
+func (d *Numaconnect2) Config() map[string]string {
+   ids := make([]string, len(d.cards))
+
+   for i, card := range d.cards {
+      ids[i] = strconv.Itoa(card.id)
+   }
+
+   return map[string]string{"cards": strings.Join(ids, ","), "resets": strconv.FormatBool(d.resets)}
 }
 
 func (d *Numaconnect2) Sources() uint {
@@ -252,7 +319,7 @@ func (d *Numaconnect2) Unlock() {
    d.mutex.Unlock()
 }
 
-func (d *Numaconnect2) Enable(discrete bool) {
+func (d *Numaconnect2) Enable(discrete bool) error {
    d.discrete = discrete
    d.nEnabled = 0
 
@@ -267,6 +334,8 @@ func (d *Numaconnect2) Enable(discrete bool) {
       d.cards[i].regs[statCtrl] = 1 | (1 << 2) // enable counting
       d.cards[i].last = make([]uint64, d.nEnabled)
    }
+
+   return nil
 }
 
 func (d *Numaconnect2) Headings(mnemonics bool) []string {
@@ -315,15 +384,7 @@ func (d *Numaconnect2) Sample() []int64 {
       d.cards[n].regs[statCtrl] = 1 // disable counting
 
       val := d.cards[n].stats[statElapsed]
-      var interval uint64 // in units of 5ns
-
-      // if wrapped, add remainder
-      if val < d.cards[n].lastElapsed {
-         interval = val + (wrapLimit - val)
-      } else {
-         interval = val - d.cards[n].lastElapsed
-      }
-
+      interval := delta(val, d.cards[n].lastElapsed, elapsedWidth) // in units of 5ns
       d.cards[n].lastElapsed = val
       i := 0
 
@@ -333,16 +394,12 @@ func (d *Numaconnect2) Sample() []int64 {
          }
 
          val = d.cards[n].stats[event.index]
-         var delta uint64
-
-         // if wrapped, add remainder
-         if val < d.cards[n].last[i] {
-            delta = val + (wrapLimit - val)
-         } else {
-            delta = val - d.cards[n].last[i]
+         diff, reset := deltaReset(val, d.cards[n].last[i], event.width, d.resets)
+         if reset {
+            noteReset(d.Name())
          }
 
-         sample := delta * 200000000 / interval // clockcycles @ 200MHz
+         sample := math.Round(float64(diff) * 200000000 * floatScale / float64(interval)) // clockcycles @ 200MHz
          d.cards[n].last[i] = val
 
          if d.discrete {
@@ -19,6 +19,8 @@ package main
 
 import (
    "fmt"
+   "os"
+   "path/filepath"
    "testing"
 )
 
@@ -31,7 +33,11 @@ func TestMain(m *testing.M) {
       events[1].enabled = true
       events[3].enabled = true
 
-      dev.Enable(true)
+      err := dev.Enable(true)
+      if err != nil {
+         fmt.Println(err)
+         os.Exit(1)
+      }
 
       for i := 0; i < 3; i++ {
          _ = dev.Sample()
@@ -39,4 +45,63 @@ func TestMain(m *testing.M) {
    } else {
       fmt.Println("Numachip2 not detected")
    }
+
+   os.Exit(m.Run())
+}
+
+func TestKernelHotEnable(t *testing.T) {
+   vmstat := filepath.Join(t.TempDir(), "vmstat")
+   write := func(free, anon uint64) {
+      err := os.WriteFile(vmstat, []byte(fmt.Sprintf("nr_free_pages %d\nnr_zone_inactive_anon %d\n", free, anon)), 0644)
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+
+   write(100, 1000)
+
+   dev := NewKernel()
+   dev.Configure(map[string]string{"path": vmstat})
+   events := dev.Events()
+   events[0].enabled = true
+
+   err := dev.Enable(false)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // enabling another event keeps the first counting from its baseline
+   write(150, 1200)
+   events[1].enabled = true
+
+   err = dev.Enable(false)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if dev.last[0] != 100 || dev.last[1] != 1200 {
+      t.Fatalf("baselines %v, want [100 1200 ...]", dev.last[:2])
+   }
+}
+
+func TestDeltaReset(t *testing.T) {
+   for _, tc := range []struct {
+      val, last uint64
+      width     uint
+      detect    bool
+      want      uint64
+      reset     bool
+   }{
+      {150, 100, 48, true, 50, false},
+      {5, 1<<48 - 10, 48, true, 15, false},  // wrapped
+      {5, 1000, 48, true, 5, true},          // cleared
+      {5, 1000, 48, false, 1<<48 - 995, false},
+      {5, 1<<64 - 10, 64, true, 15, false},
+      {5, 1000, 64, true, 5, true},
+   } {
+      got, reset := deltaReset(tc.val, tc.last, tc.width, tc.detect)
+      if got != tc.want || reset != tc.reset {
+         t.Errorf("%+v: got %d, %v", tc, got, reset)
+      }
+   }
 }
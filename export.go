@@ -0,0 +1,106 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "os"
+)
+
+// Chrome trace event file written alongside a recording, for viewers such as Perfetto
+var traceFile *os.File
+
+// the closing ']' is optional in this format, so a killed recording still loads
+func traceOpen(name string) {
+   var err error
+   traceFile, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+   validate(err)
+
+   process, err := json.Marshal("numascope " + primary.Name())
+   validate(err)
+
+   _, err = fmt.Fprintf(traceFile, "[\n{\"name\":\"process_name\",\"ph\":\"M\",\"pid\":1,\"args\":{\"name\":%s}}", process)
+   validate(err)
+}
+
+func traceClose() {
+   if traceFile == nil {
+      return
+   }
+
+   _, err := traceFile.WriteString("\n]\n")
+   validate(err)
+
+   err = traceFile.Close()
+   validate(err)
+   traceFile = nil
+}
+
+// trace timestamps are in wall-clock microseconds
+func traceTime(timestamp int64) int64 {
+   return (origin() + timestamp) * timeUnit() / 1e3
+}
+
+// writes each value of a sample as a counter track named by its heading
+func traceCounters(line []int64, headings []string, floats []bool) {
+   if traceFile == nil {
+      return
+   }
+
+   ts := traceTime(line[0])
+   var b []byte
+
+   for j, heading := range headings {
+      if j+1 >= len(line) {
+         break
+      }
+
+      name, err := json.Marshal(heading)
+      validate(err)
+
+      b = append(b, ",\n{\"name\":"...)
+      b = append(b, name...)
+      b = append(b, fmt.Sprintf(",\"ph\":\"C\",\"ts\":%d,\"pid\":1,\"args\":{\"value\":", ts)...)
+      b = appendSample(b, line[j+1], floatAt(floats, j+1), 0, false)
+      b = append(b, "}}"...)
+   }
+
+   _, err := traceFile.Write(b)
+   validate(err)
+}
+
+// writes a label as a global instant event
+func traceLabel(timestamp int64, channel, label string) {
+   if traceFile == nil {
+      return
+   }
+
+   b, err := json.Marshal(map[string]interface{}{
+      "name": label,
+      "ph":   "i",
+      "s":    "g",
+      "ts":   traceTime(timestamp),
+      "pid":  1,
+      "args": map[string]string{"channel": channel},
+   })
+   validate(err)
+
+   _, err = traceFile.Write(append([]byte(",\n"), b...))
+   validate(err)
+}
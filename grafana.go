@@ -0,0 +1,134 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "net/http"
+   "strings"
+   "time"
+)
+
+// implements the Grafana SimpleJSON datasource, served from the history buffer
+
+type grafanaSearch struct {
+   Target string `json:"target"`
+}
+
+type grafanaQuery struct {
+   Range struct {
+      From time.Time `json:"from"`
+      To   time.Time `json:"to"`
+   } `json:"range"`
+   Targets []struct {
+      Target string `json:"target"`
+   } `json:"targets"`
+   MaxDataPoints int `json:"maxDataPoints"`
+}
+
+type grafanaSeries struct {
+   Target     string     `json:"target"`
+   Datapoints [][2]float64 `json:"datapoints"` // value, milliseconds since epoch
+}
+
+func grafanaJSON(w http.ResponseWriter, val interface{}) {
+   w.Header().Set("Content-Type", "application/json")
+   _ = json.NewEncoder(w).Encode(val)
+}
+
+// datasource connection test
+func grafanaRoot(w http.ResponseWriter, r *http.Request) {
+   if !authorized(r) {
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   w.WriteHeader(http.StatusOK)
+}
+
+// lists enabled events as targets
+func grafanaTargets(w http.ResponseWriter, r *http.Request) {
+   if !authorized(r) {
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   var req grafanaSearch
+   _ = json.NewDecoder(r.Body).Decode(&req)
+
+   sampling.Lock()
+   names := headings()
+   sampling.Unlock()
+
+   targets := []string{}
+
+   for _, name := range names {
+      if strings.Contains(name, req.Target) {
+         targets = append(targets, name)
+      }
+   }
+
+   grafanaJSON(w, targets)
+}
+
+func grafanaData(w http.ResponseWriter, r *http.Request) {
+   if !authorized(r) {
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   var req grafanaQuery
+   err := json.NewDecoder(r.Body).Decode(&req)
+   if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+   }
+
+   unit := timeUnit()
+   base := origin()
+   entries := recall(req.Range.From.UnixNano() / unit - base, req.Range.To.UnixNano() / unit - base)
+
+   // thin out to the requested number of points
+   step := 1
+   if req.MaxDataPoints > 0 && len(entries) > req.MaxDataPoints {
+      step = (len(entries) + req.MaxDataPoints - 1) / req.MaxDataPoints
+   }
+
+   series := []grafanaSeries{}
+
+   for _, target := range req.Targets {
+      s := grafanaSeries{Target: target.Target, Datapoints: [][2]float64{}}
+
+      for i := 0; i < len(entries); i += step {
+         entry := entries[i]
+
+         for col, name := range entry.columns {
+            if name == target.Target {
+               ms := (entry.values[0] + base) * unit / 1e6
+               s.Datapoints = append(s.Datapoints, [2]float64{entry.value(col+1), float64(ms)})
+               break
+            }
+         }
+      }
+
+      series = append(series, s)
+   }
+
+   grafanaJSON(w, series)
+}
@@ -0,0 +1,73 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "net/http"
+   "net/http/httptest"
+   "strings"
+   "testing"
+)
+
+func TestGrafanaQuery(t *testing.T) {
+   saved := *historyLen
+   *historyLen = 4
+   history, historyNext = nil, 0
+   defer func() {
+      *historyLen = saved
+   }()
+
+   // overfill so the oldest sample is dropped
+   for i := int64(1); i <= 5; i++ {
+      remember([]string{"a", "b"}, nil, []int64{i * 1e6, i, i * 10})
+   }
+
+   body := `{"range":{"from":"1970-01-01T00:00:02Z","to":"1970-01-01T00:00:04Z"},"targets":[{"target":"b"}]}`
+   req := httptest.NewRequest("POST", "/grafana/query", strings.NewReader(body))
+   req.Header.Set("Authorization", "Bearer "+*token)
+   w := httptest.NewRecorder()
+   grafanaData(w, req)
+
+   var series []grafanaSeries
+   err := json.Unmarshal(w.Body.Bytes(), &series)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := [][2]float64{{20, 2000}, {30, 3000}, {40, 4000}}
+   if len(series) != 1 || len(series[0].Datapoints) != len(want) {
+      t.Fatalf("got %+v", series)
+   }
+
+   for i := range want {
+      if series[0].Datapoints[i] != want[i] {
+         t.Fatalf("got %+v, want %v", series[0].Datapoints, want)
+      }
+   }
+
+   // token required
+   req = httptest.NewRequest("POST", "/grafana/query", strings.NewReader(body))
+   w = httptest.NewRecorder()
+   grafanaData(w, req)
+
+   if w.Code != http.StatusUnauthorized {
+      t.Fatalf("got status %d without token", w.Code)
+   }
+}
@@ -0,0 +1,120 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "sync"
+)
+
+type historyEntry struct {
+   columns []string // shared between consecutive entries with the same layout
+   values  []int64  // timestamp first, then a value per column
+   floats  []bool   // whether each of values is fixed point; nil if none are
+}
+
+var (
+   history      []historyEntry // ring buffer of the last *historyLen samples
+   historyNext  int
+   historyMutex sync.Mutex
+)
+
+// names of the values in each sample, in column order
+func headings() []string {
+   var names []string
+
+   for _, sensor := range present {
+      names = append(names, sensor.Headings(false)...)
+   }
+
+   return names
+}
+
+func equal(a, b []string) bool {
+   if len(a) != len(b) {
+      return false
+   }
+
+   for i := range a {
+      if a[i] != b[i] {
+         return false
+      }
+   }
+
+   return true
+}
+
+func equalInts(a, b []int) bool {
+   if len(a) != len(b) {
+      return false
+   }
+
+   for i := range a {
+      if a[i] != b[i] {
+         return false
+      }
+   }
+
+   return true
+}
+
+// value at index i of an entry
+func (e historyEntry) value(i int) float64 {
+   if floatAt(e.floats, i) {
+      return float64(e.values[i]) / floatScale
+   }
+
+   return float64(e.values[i])
+}
+
+// keeps a sample for later queries
+func remember(columns []string, floats []bool, samples []int64) {
+   historyMutex.Lock()
+   defer historyMutex.Unlock()
+
+   if len(history) < *historyLen {
+      history = append(history, historyEntry{})
+   }
+
+   // avoid holding a copy of the layout per entry
+   last := (historyNext + len(history) - 1) % len(history)
+   if history[last].columns != nil && equal(history[last].columns, columns) {
+      columns = history[last].columns
+   }
+
+   history[historyNext] = historyEntry{columns: columns, values: samples, floats: floats}
+   historyNext = (historyNext + 1) % *historyLen
+}
+
+// samples with timestamps from 'from' to 'to' inclusive, oldest first
+func recall(from, to int64) []historyEntry {
+   historyMutex.Lock()
+   defer historyMutex.Unlock()
+
+   var out []historyEntry
+
+   for i := range history {
+      entry := history[(historyNext + i) % len(history)]
+
+      if entry.values[0] >= from && entry.values[0] <= to {
+         out = append(out, entry)
+      }
+   }
+
+   return out
+}
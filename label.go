@@ -0,0 +1,254 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "bytes"
+   "fmt"
+   "io"
+   "strings"
+   "syscall"
+   "time"
+   "unicode"
+
+   "golang.org/x/sys/unix"
+)
+
+// adapts a non-blocking file descriptor to io.Reader
+type fdReader int
+
+func (fd fdReader) Read(p []byte) (int, error) {
+   n, err := unix.Read(int(fd), p)
+   if n < 0 {
+      n = 0
+   }
+
+   return n, err
+}
+
+// returns any pending label, or an empty string if there is none
+func readLabel(r io.Reader, buf []byte) (string, error) {
+   n, err := r.Read(buf)
+
+   if err == syscall.EAGAIN || err == io.EOF {
+      return "", nil
+   }
+
+   if err != nil {
+      return "", err
+   }
+
+   return string(bytes.TrimSpace(buf[:n])), nil
+}
+
+// drops non-printable characters, which could break rendering in clients, and
+// truncates to max characters if non-zero
+func sanitizeLabel(label string, max int) string {
+   label = strings.ToValidUTF8(label, "")
+
+   clean := strings.Map(func(r rune) rune {
+      if !unicode.IsPrint(r) {
+         return -1
+      }
+
+      return r
+   }, label)
+
+   runes := []rune(clean)
+   if max > 0 && len(runes) > max {
+      clean = string(runes[:max])
+   }
+
+   return strings.TrimSpace(clean)
+}
+
+// a FIFO from which labels are read
+type labelChannel struct {
+   name     string // empty for the control FIFO
+   path     string
+   fd       int // -1 while waiting to reopen
+   failures int // consecutive failed reopens
+   retry    time.Time // when to next try reopening
+   disabled bool // gave up reopening
+}
+
+// a label and the channel it arrived on
+type namedLabel struct {
+   channel string
+   label   string
+}
+
+// the previous label on each channel, for suppressing repeats
+type lastLabel struct {
+   label string
+   at    time.Time
+}
+
+var lastLabels = map[string]lastLabel{}
+
+// whether a label repeats the previous one on its channel within -label-dedup;
+// only the first of a run is kept, with the window counted from it
+func repeated(channel, label string, at time.Time) bool {
+   if *labelDedup <= 0 {
+      return false
+   }
+
+   last, ok := lastLabels[channel]
+   if ok && last.label == label && at.Sub(last.at) < *labelDedup {
+      return true
+   }
+
+   lastLabels[channel] = lastLabel{label, at}
+   return false
+}
+
+// reopen attempts before a channel is given up on; the delay doubles from a second
+const maxReopens = 6
+
+// the control FIFO, then any named channels
+var channels []*labelChannel
+
+// creates the FIFO if needed and opens it
+func openFifo(path string) (int, error) {
+   // expected to fail if already exists
+   _ = unix.Mkfifo(path, 0666)
+
+   return unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+}
+
+func openChannel(name, path string) {
+   fd, err := openFifo(path)
+   validate(err)
+
+   channels = append(channels, &labelChannel{name: name, path: path, fd: fd})
+}
+
+func openChannels() {
+   unix.Umask(0)
+   openChannel("", fifoPath)
+
+   if *labelChannels == "" {
+      return
+   }
+
+   for _, elem := range strings.Split(*labelChannels, ",") {
+      name, path, _ := strings.Cut(elem, "=")
+      openChannel(name, path)
+   }
+}
+
+// whether the FIFO was removed, so writers can no longer reach this descriptor
+func removed(fd int) bool {
+   var st unix.Stat_t
+   return unix.Fstat(fd, &st) == nil && st.Nlink == 0
+}
+
+// closes a channel which failed, to be reopened later
+func (ch *labelChannel) fail(err error) {
+   unix.Close(ch.fd)
+   ch.fd = -1
+   ch.retry = time.Now().Add(time.Second)
+
+   logf("warn", logFields{"path": ch.path, "error": err.Error()}, "label FIFO %s failed: %v; reopening", ch.path, err)
+}
+
+// tries reopening once the backoff has passed, giving up after maxReopens attempts;
+// sampling carries on regardless
+func (ch *labelChannel) reopen() {
+   if time.Now().Before(ch.retry) {
+      return
+   }
+
+   fd, err := openFifo(ch.path)
+   if err == nil {
+      ch.fd = fd
+      ch.failures = 0
+      logf("info", logFields{"path": ch.path}, "label FIFO %s reopened", ch.path)
+      return
+   }
+
+   ch.failures++
+   if ch.failures == maxReopens {
+      ch.disabled = true
+      logf("warn", logFields{"path": ch.path, "error": err.Error()}, "label FIFO %s can't be reopened: %v; ignoring it", ch.path, err)
+      return
+   }
+
+   debugf("labels", "reopening %s failed: %v\n", ch.path, err)
+   ch.retry = time.Now().Add(time.Second << ch.failures)
+}
+
+func (ch *labelChannel) pending(buf []byte) string {
+   if ch.disabled {
+      return ""
+   }
+
+   if ch.fd < 0 {
+      ch.reopen()
+      if ch.fd < 0 {
+         return ""
+      }
+   }
+
+   if removed(ch.fd) {
+      ch.fail(fmt.Errorf("removed"))
+      return ""
+   }
+
+   label, err := readLabel(fdReader(ch.fd), buf)
+   if err != nil {
+      ch.fail(err)
+      return ""
+   }
+
+   label = sanitizeLabel(label, *maxLabel)
+
+   if label != "" {
+      debugf("labels", "read %q from channel '%s'\n", label, ch.name)
+   }
+
+   return label
+}
+
+// returns any label written to the control FIFO
+func pendingLabel(buf []byte) string {
+   if *noLabels {
+      return ""
+   }
+
+   return channels[0].pending(buf)
+}
+
+// returns any labels written to the named channels
+func channelLabels(buf []byte) []namedLabel {
+   if *noLabels {
+      return nil
+   }
+
+   var labels []namedLabel
+
+   for _, ch := range channels[1:] {
+      label := ch.pending(buf)
+      if label != "" {
+         labels = append(labels, namedLabel{ch.name, label})
+      }
+   }
+
+   return labels
+}
@@ -0,0 +1,162 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "os"
+   "path/filepath"
+   "strings"
+   "syscall"
+   "testing"
+   "time"
+)
+
+// behaves like a non-blocking FIFO with nothing written
+type emptyFifo struct{}
+
+func (emptyFifo) Read(p []byte) (int, error) {
+   return 0, syscall.EAGAIN
+}
+
+func TestReadLabelEmpty(t *testing.T) {
+   label, err := readLabel(emptyFifo{}, make([]byte, 256))
+   if err != nil || label != "" {
+      t.Fatalf("got %q, %v; want no label", label, err)
+   }
+}
+
+func TestReadLabel(t *testing.T) {
+   label, err := readLabel(strings.NewReader("phase 1"), make([]byte, 256))
+   if err != nil || label != "phase 1" {
+      t.Fatalf("got %q, %v", label, err)
+   }
+}
+
+func TestReadLabelWhitespace(t *testing.T) {
+   label, err := readLabel(strings.NewReader("phase 2 \n"), make([]byte, 256))
+   if err != nil || label != "phase 2" {
+      t.Fatalf("got %q, %v", label, err)
+   }
+}
+
+func TestReadLabelOverlong(t *testing.T) {
+   r := strings.NewReader("abcdefghijkl")
+   buf := make([]byte, 8)
+
+   label, err := readLabel(r, buf)
+   if err != nil || label != "abcdefgh" {
+      t.Fatalf("got %q, %v", label, err)
+   }
+
+   // remainder arrives on the next read
+   label, err = readLabel(r, buf)
+   if err != nil || label != "ijkl" {
+      t.Fatalf("got %q, %v", label, err)
+   }
+}
+
+func TestSanitizeLabelControl(t *testing.T) {
+   label := sanitizeLabel("phase\x1b[2J 3\x07\x00‮ done\xff", 0)
+   if label != "phase[2J 3 done" {
+      t.Fatalf("got %q", label)
+   }
+}
+
+func TestSanitizeLabelOverlong(t *testing.T) {
+   label := sanitizeLabel(strings.Repeat("é", 300), 256)
+   if label != strings.Repeat("é", 256) {
+      t.Fatalf("got %d characters, want 256", len([]rune(label)))
+   }
+}
+
+func TestChannelReopen(t *testing.T) {
+   dir := filepath.Join(t.TempDir(), "fifos")
+   err := os.Mkdir(dir, 0755)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   path := filepath.Join(dir, "labels")
+   fd, err := openFifo(path)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   ch := &labelChannel{name: "test", path: path, fd: fd}
+   buf := make([]byte, 256)
+
+   // removed underneath, so recreated once the backoff passes
+   os.Remove(path)
+   if ch.pending(buf) != "" || ch.fd != -1 {
+      t.Fatalf("removal not detected, fd %d", ch.fd)
+   }
+
+   ch.pending(buf)
+   if ch.fd != -1 {
+      t.Fatal("reopened before the backoff passed")
+   }
+
+   ch.retry = time.Time{}
+   ch.pending(buf)
+   if ch.fd < 0 {
+      t.Fatal("not reopened")
+   }
+
+   // the directory is gone too, so reopening keeps failing
+   os.RemoveAll(dir)
+
+   for i := 0; i <= maxReopens && !ch.disabled; i++ {
+      ch.pending(buf)
+      ch.retry = time.Time{}
+   }
+
+   if !ch.disabled {
+      t.Fatal("channel not disabled")
+   }
+}
+
+func TestRepeatedLabels(t *testing.T) {
+   *labelDedup = time.Second
+   lastLabels = map[string]lastLabel{}
+   defer func() {
+      *labelDedup = 0
+   }()
+
+   start := time.Now()
+   at := func(ms int) time.Time {
+      return start.Add(time.Duration(ms) * time.Millisecond)
+   }
+
+   for _, c := range []struct {
+      channel, label string
+      ms             int
+      want           bool
+   }{
+      {"", "phase 1", 0, false},
+      {"", "phase 1", 500, true},
+      {"anomaly", "phase 1", 600, false}, // other channels are separate
+      {"", "phase 2", 700, false},
+      {"", "phase 1", 800, false}, // a different label came between
+      {"", "phase 1", 1900, false}, // outside the window
+   } {
+      if got := repeated(c.channel, c.label, at(c.ms)); got != c.want {
+         t.Errorf("%q on '%s' at %dms: repeated %v; want %v", c.label, c.channel, c.ms, got, c.want)
+      }
+   }
+}
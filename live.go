@@ -19,342 +19,2237 @@ package main
 
 import (
    "bytes"
+   "context"
+   "encoding/json"
+   "errors"
+   "flag"
    "fmt"
+   "io"
+   "io/fs"
+   "math"
+   "net"
    "net/http"
+   "os"
+   "os/signal"
+   "path"
+   "path/filepath"
    "strconv"
    "strings"
    "sync"
+   "sync/atomic"
+   "syscall"
    "time"
 
    "github.com/gorilla/websocket"
-   "golang.org/x/sys/unix"
 )
 
+// incremented on incompatible changes to the messages below; see doc/protocol.md
+const protocolVersion = 1
+
+// websocket subprotocol clients may request; changes with protocolVersion
+const subprotocol = "numascope.v1"
+
+// optional features this server supports, for clients to detect
+func capabilities() []string {
+   caps := []string{"verbose", "chunked", "order", "pattern", "resume", "sample", "mask", "freeze", "pause-sampling", "stream"}
+
+   if *summaryWindow > 0 {
+      caps = append(caps, "summary")
+   }
+
+   if *maxFrameBytes > 0 {
+      caps = append(caps, "continued")
+   }
+
+   if *historyLen > 0 {
+      caps = append(caps, "backfill")
+   }
+
+   if *compressLevel > 0 {
+      caps = append(caps, "compression")
+   }
+
+   return caps
+}
+
+// reply to /capabilities, for deciding how to connect before presenting the token
+type CapabilitiesMessage struct {
+   Version      int
+   Subprotocol  string
+   HandshakeAuth string // -handshake-auth
+   Capabilities []string
+   Order        []string // sensors in column order
+   Tree         map[string][]string // sensor name to every event description it supports
+}
+
+func capabilitiesEndpoint(w http.ResponseWriter, r *http.Request) {
+   if !*publicCapabilities {
+      http.Error(w, "not enabled; see -public-capabilities", http.StatusNotFound)
+      return
+   }
+
+   msg := CapabilitiesMessage{
+      Version:      protocolVersion,
+      Subprotocol:  subprotocol,
+      HandshakeAuth: *handshakeAuth,
+      Capabilities: capabilities(),
+      Tree:         make(map[string][]string, len(present)),
+   }
+
+   for _, sensor := range present {
+      name := sensor.Name()
+      msg.Order = append(msg.Order, name)
+      msg.Tree[name] = []string{}
+
+      for _, event := range sensor.Events() {
+         msg.Tree[name] = append(msg.Tree[name], event.desc)
+      }
+   }
+
+   grafanaJSON(w, &msg)
+}
+
 type SignonMessage struct {
+   Version   int
    Timestamp int64
+   Precision string
+   Order     []string // sensors in column order
    Tree      map[string][]string
    Sources   map[string]uint
+   Config    map[string]map[string]string
+   MaxColumns int
+   SafeIntegers bool // values beyond 2^53 are sent as strings
+   Coalesce  string // time, count or hybrid
+   Session   string // identifies this connection's settings for the resume op
+   NullColumns bool // data has a column for every event, null if disabled
+   Spectator bool // requests changing server state are refused
+   Verbose   bool // data is sent as objects keyed by sensor, event and source
+   Connection string // ID of this connection in the server's logs
+   Host      string // hostname, to tell instances apart
+   NodeName  string // operator-chosen name, else the hostname
+   MachineID string // stable across hostname changes, empty if unknown
+   Types     map[string][]string // int or float, for each event in Tree
+   Chunked   bool // Tree, Sources, Config and Types follow in parts
+   Clock     string // wall or monotonic
+   Hints     map[string]map[string]map[string]string // sensor name to event description to display hints, for events with any
+   Weights   map[string][]float64 // sensor name to the weight of each source when summing, for sensors with any
+   Origin    int64 // wall time of monotonic timestamp 0, else 0
+   Capabilities []string // optional features supported
+}
+
+// some of a sensor's events, for a chunked signon
+type SignonPart struct {
+   Op      string
+   Sensor  string
+   Offset  int // in the sensor's tree of the first of Events
+   Events  []string
+   Types   []string
+   Sources uint
+   Config  map[string]string
+   Hints   map[string]map[string]string // by event description, for events with any
+   Weights []float64 // of each source when summing, if not all 1
 }
 
 type ChangeMessage struct {
    Op        string
    Timestamp int64
    Interval  int
+   Achieved  float64 // mean ms between samples recently taken, 0 if unknown
    Discrete  bool
+   Columns   int
    Enabled   map[string][]string
+   Index     map[string][]int // column of each enabled event's first value
+   SourceIndex map[string][]int // index of each source sent, as some may be masked
+   Clients   int // connected clients, including this one
+   Paused    bool // sampling is paused for everyone
 }
 
 type LabelMessage struct {
    Op        string
    Timestamp int64
    Label     string
+   Channel   string // empty for the control FIFO
+}
+
+type PatternMessage struct {
+   Op      string
+   Pattern string
+   Matched int
+}
+
+// a piece of a data message too large for one frame
+type ContinuedMessage struct {
+   Op   string
+   More bool // false on the last piece
+   Data string
+}
+
+// reply to the config op
+type ConfigMessage struct {
+   Op       string
+   Settings map[string]string
+   Sampling map[string]SamplingCost
+}
+
+type HeartbeatMessage struct {
+   Op        string
+   Timestamp int64
+   Columns   int
+}
+
+type ErrorMessage struct {
+   Op      string
+   Code    string
+   Message string
+}
+
+// error codes
+const (
+   errUnknownOp    = "unknown-op"
+   errInvalidValue = "invalid-value"
+   errLimit        = "limit"
+   errUnknownEvent = "unknown-event"
+   errConfig       = "config"
+   errSensor       = "sensor"
+   errForbidden    = "forbidden"
+   errMalformed    = "malformed"
+)
+
+// ops affecting the server or other clients, refused for spectators
+var mutating = map[string]bool{
+   "update":    true,
+   "pattern":   true,
+   "reset":     true,
+   "averaging": true,
+   "interval":  true, // the server samples at the fastest interval requested
+   "mask":      true,
+   "sample":    true, // reads the sensors
+   "pause-sampling":  true,
+   "resume-sampling": true,
+}
+
+// an error attributable to a client request
+type opError struct {
+   code    string
+   message string
+}
+
+func (e *opError) Error() string {
+   return e.message
+}
+
+// what the broadcast layer needs of a websocket, so tests can substitute their own
+type transport interface {
+   ReadMessage() (int, []byte, error)
+   WriteMessage(messageType int, data []byte) error
+   WriteControl(messageType int, data []byte, deadline time.Time) error
+   EnableWriteCompression(enable bool)
+   SetWriteDeadline(t time.Time) error
+   Close() error
 }
 
 type Connection struct {
-   socket  *websocket.Conn
-   mutex   *sync.Mutex
-   stopped bool
+   socket   transport
+   mutex    *sync.Mutex
+   stopped  bool
+   interval int   // requested interval in ms; 0 follows the global interval; protected by mutex
+   digits   int   // significant figures to round values to; 0 sends them exactly; protected by mutex
+   last     int64 // timestamp of last epoch sent, protected by mutex
+   first    int64 // timestamp of the first epoch sent, protected by mutex
+   failed   uint64 // writes which failed, accessed atomically
+   addr     string
+   id       string // attributes log messages to this connection
+   session  string // lets a reconnecting client resume these settings
+   spectator bool  // authenticated read-only, so can't change what others see
+   verbose  bool  // data is sent keyed by sensor, event and source rather than as arrays
+   chunked  bool  // accepts the signon in parts
+   tracing  int32  // non-zero to log this connection's frames, accessed atomically
+   lastSample time.Time // of the last sample op
+   lastWrite time.Time // protected by mutex
+   failing  int // consecutive failed writes, protected by mutex
+   maxFailures int // consecutive failed writes before dropping, 0 to never
+   frozen   bool // holding frame rather than sending data, protected by mutex
+   frame    []byte // last data message sent, protected by mutex
+   order    []string // sensor names and event mnemonics to send first; nil for the default order
+   due      time.Time // when this client next wants a sample with -lazy; only used by the sampling loop
+   writing  int64 // UnixNano when the current write began, 0 if none; accessed atomically
+   slot     bool // holds one of reserved until registered, protected by connMutex
 }
 
 var (
-   upgrader = websocket.Upgrader{}
+   upgrader = websocket.Upgrader{Subprotocols: []string{subprotocol}}
+   server   = &http.Server{}
    connections []*Connection
+   reserved  int // -max-connections slots held by clients still signing on, protected by connMutex
+   connMutex sync.Mutex
+   // keeps enabling and discarding the first sample atomic with respect to sampling
+   sampling sync.Mutex
 )
 
-func live() {
-   initweb(*listenAddr)
-   labelBuf := make([]byte, 256)
+// snapshot of connections, safe to iterate without holding the lock
+func clients() []*Connection {
+   connMutex.Lock()
+   defer connMutex.Unlock()
 
-   var lastTimestamp int64 = 0
-   var epochs [][]int64
+   return append([]*Connection(nil), connections...)
+}
 
-   for {
-      time.Sleep(time.Duration(*interval) * time.Millisecond)
+// holds a -max-connections slot for c while it signs on, returning false if none is free;
+// checked and held under one lock, so simultaneous clients can't exceed the limit
+func (c *Connection) reserve() bool {
+   connMutex.Lock()
+   defer connMutex.Unlock()
 
-      // forward any label
-      n, err := unix.Read(fifo, labelBuf)
-      validateNonblock(err)
+   if *maxConnections > 0 && len(connections) + reserved >= *maxConnections {
+      return false
+   }
 
-      timestamp := time.Now().UnixNano() / 1e3
+   reserved++
+   c.slot = true
+   return true
+}
 
-      if n > 0 {
-         broadcastLabel(timestamp, string(bytes.TrimSpace(labelBuf[:n])))
-      }
+// frees c's slot, unless it was taken over by registering; connMutex must be held
+func (c *Connection) unreserveLocked() {
+   if c.slot {
+      reserved--
+      c.slot = false
+   }
+}
 
-      // avoid wasting processor time
-      if len(connections) == 0 {
-         continue
-      }
+// frees c's slot if it never registered
+func (c *Connection) unreserve() {
+   connMutex.Lock()
+   c.unreserveLocked()
+   connMutex.Unlock()
+}
 
-      samples := []int64{timestamp}
+// number of connected clients, counting c as one even before it is registered
+func viewers(c *Connection) int {
+   connMutex.Lock()
+   defer connMutex.Unlock()
 
-      for _, sensor := range present {
-         samples = append(samples, sensor.Sample()...)
+   for _, other := range connections {
+      if other == c {
+         return len(connections)
       }
+   }
 
-      // coalesce
-      if timestamp - lastTimestamp < coalescing || len(epochs) == 0 {
-         epochs = append(epochs, samples)
-      } else {
-         broadcastData(epochs)
-         lastTimestamp = timestamp
-         epochs = nil
-      }
+   return len(connections) + 1
+}
+
+// closes with a reason hinting when the client should reconnect
+func closeRetry(socket transport, code int, reason string, retry time.Duration) {
+   msg := websocket.FormatCloseMessage(code, fmt.Sprintf("retry-after=%d %s", int(retry.Seconds()), reason))
+   _ = socket.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// lets clients know to come back after a restart
+func shutdown() {
+   sigs := make(chan os.Signal, 1)
+   signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+   <-sigs
+
+   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+   defer cancel()
+
+   err := Shutdown(ctx)
+   if err != nil {
+      logf("warn", logFields{"error": err.Error()}, "shutdown incomplete: %v", err)
    }
+
+   os.Exit(0)
 }
 
-func (c *Connection) WriteJSON(msg interface{}) error {
-   if *debug {
-      fmt.Printf("-> %+v\n", msg)
+// stops accepting connections, asks clients to close and disables sensors; clients
+// still connected when ctx is done are closed forcibly
+func Shutdown(ctx context.Context) error {
+   // hijacked websocket connections aren't affected
+   err := server.Shutdown(ctx)
+
+   for _, c := range clients() {
+      closeRetry(c.socket, websocket.CloseGoingAway, "shutting down", 5*time.Second)
    }
 
-   c.mutex.Lock()
-   err := c.socket.WriteJSON(msg)
-   c.mutex.Unlock()
+   // each client's reader removes it once it replies to the close
+wait:
+   for len(clients()) > 0 {
+      select {
+      case <-ctx.Done():
+         for _, c := range clients() {
+            c.socket.Close()
+         }
+
+         err = ctx.Err()
+         break wait
+      case <-time.After(10 * time.Millisecond):
+      }
+   }
+
+   sampling.Lock()
+   defer sampling.Unlock()
+
+   for _, sensor := range present {
+      sensor.Lock()
+
+      events := sensor.Events()
+      for i := range events {
+         events[i].enabled = false
+      }
+
+      _ = sensor.Enable(*discrete)
+      sensor.Unlock()
+   }
 
    return err
 }
 
-func change(c Connection) {
-   msg := ChangeMessage{
-      Op: "enabled",
-      Timestamp: time.Now().UnixNano() / 1e3,
-      Interval: *interval,
-      Discrete: *discrete,
-      Enabled: make(map[string][]string),
+func live() {
+   if *listenAddr != "" {
+      initweb(*listenAddr)
+   } else if *metricsListen != "" {
+      initMetrics(*metricsListen)
    }
 
-   // structure events into hashmap
-   for _, sensor := range present {
-      name := sensor.Name()
-      msg.Enabled[name] = make([]string, 0, 16)
+   if *collector != "" {
+      go collect(*collector)
+   }
 
-      for _, event := range sensor.Events() {
-         if event.enabled {
-            msg.Enabled[name] = append(msg.Enabled[name], event.desc)
+   go shutdown()
+
+   if *writeStall > 0 {
+      go watchdog()
+   }
+
+   labelBuf := make([]byte, 256)
+
+   for {
+      if *lazy {
+         time.Sleep(nextDue(time.Now()))
+      } else {
+         time.Sleep(time.Duration(sampleInterval()) * time.Millisecond)
+      }
+
+      // forward any label, stamped as the sample taken with it
+      label := pendingLabel(labelBuf)
+
+      timestamp := now()
+
+      if label != "" && !repeated("", label, time.Now()) {
+         broadcastLabel(timestamp, "", label)
+      }
+
+      for _, l := range channelLabels(labelBuf) {
+         if !repeated(l.channel, l.label, time.Now()) {
+            broadcastLabel(timestamp, l.channel, l.label)
          }
       }
-   }
 
-   err := c.WriteJSON(&msg)
-   if err != nil && *debug {
-      fmt.Println("failed writing:", err)
+      heartbeat(timestamp)
+
+      // avoid wasting processor time, unless keeping history for later queries
+      if isPaused() || !samplesWanted() || columns(*discrete) == 0 {
+         continue
+      }
+
+      if *lazy && !takeDue(time.Now()) {
+         continue
+      }
+
+      samples, layout := sampleAll(timestamp)
+      noteSample(time.Now())
+
+      coalesce(samples, layout)
    }
 }
 
-func broadcastLabel(timestamp int64, label string) {
-   msg := LabelMessage{
-      Op: "label",
-      Timestamp: timestamp,
-      Label: label,
+// samples taken but not yet sent; labels send them first, so clients receive
+// labels and samples in timestamp order
+var (
+   batch      [][]int64
+   batchLayout []int // of the batched samples, with -null-columns
+   batchSent  int64 // timestamp of the last sample sent
+   batchMutex sync.Mutex
+)
+
+// adds a sample to the batch, sending the batch if due
+func coalesce(samples []int64, layout []int) {
+   batchMutex.Lock()
+   defer batchMutex.Unlock()
+
+   // events changed since the batched samples were taken
+   if !equalInts(layout, batchLayout) {
+      flushLocked()
    }
 
-   for _, c := range connections {
-      err := c.WriteJSON(&msg)
-      if err != nil && *debug {
-         fmt.Println("failed writing:", err)
-      }
+   batch = append(batch, samples)
+   batchLayout = layout
+
+   if flushDue(len(batch), samples[0] - batchSent) {
+      flushLocked()
    }
 }
 
-func broadcastData(epochs [][]int64) {
-   for _, c := range connections {
-      if c.stopped {
-         continue
-      }
+// sends any batched samples; batchMutex must be held
+func flushLocked() {
+   if len(batch) == 0 {
+      return
+   }
+
+   broadcastData(batch, batchLayout)
+   batchSent = batch[len(batch)-1][0]
+   batch = nil
+}
 
-      err := c.WriteJSON(&epochs)
+// number of samples batched, not yet sent
+func batched() int {
+   batchMutex.Lock()
+   defer batchMutex.Unlock()
 
-      if err != nil && *debug {
-         fmt.Println("failed writing:", err)
-      }
-   }
+   return len(batch)
 }
 
-func remove(c *websocket.Conn) {
-   for i := range connections {
-      if connections[i].socket == c {
-         connections[i] = connections[len(connections)-1]
-         connections = connections[:len(connections)-1]
-         return
-      }
+// whether every sample is sent as soon as it is taken
+func noCoalescing() bool {
+   return *noCoalesce || coalescingSetting() == 0
+}
+
+// whether batched samples should be sent, given how many there are and the time since the last send
+func flushDue(batched int, age int64) bool {
+   if noCoalescing() {
+      return true
+   }
+
+   window := int64(coalescingSetting()) * 1e3 / timeUnit()
+
+   switch *coalesceMode {
+   case "count":
+      return batched >= *coalesceCount
+   case "hybrid":
+      return batched >= *coalesceCount || age >= window
    }
 
-   panic("element not found")
+   return age >= window
 }
 
-func state(desc string, state bool) {
-   for _, sensor := range present {
-      events := sensor.Events()
-      sensor.Lock()
+// non-zero while sampling is paused server-wide, accessed atomically
+var paused int32
 
-      // check if 'all' button was selected
-      if desc == /*sensor.Name() +*/ "all" {
-         for i := range events {
-            events[i].enabled = true
-         }
+func isPaused() bool {
+   return atomic.LoadInt32(&paused) != 0
+}
 
-         sensor.Enable(*discrete)
-         sensor.Unlock()
-         // discard values to initialise last
-         sensor.Sample()
-         return
+// stops or restarts reading sensors for everyone, returning false if already so;
+// resuming re-baselines so the first values don't span the pause
+func pauseSampling(pause bool) bool {
+   if pause {
+      if !atomic.CompareAndSwapInt32(&paused, 0, 1) {
+         return false
       }
 
-      for i := range events {
-         if events[i].desc == desc {
-            events[i].enabled = state
-            sensor.Enable(*discrete)
-            sensor.Unlock()
-            // discard values to initialise last
-            sensor.Sample()
-            return
-         }
+      // rather than holding samples already taken until sampling resumes
+      batchMutex.Lock()
+      flushLocked()
+      batchMutex.Unlock()
+   } else {
+      // the sampling loop can't sample until the stale baselines are discarded
+      sampling.Lock()
+      if atomic.LoadInt32(&paused) == 0 {
+         sampling.Unlock()
+         return false
       }
 
-      sensor.Unlock()
+      discardSamples()
+      atomic.StoreInt32(&paused, 0)
+      sampling.Unlock()
+
+      resetSummaries()
+      broadcastLabel(now(), "", "reset")
    }
 
-   panic("event '"+desc+"' not found")
+   logf("info", logFields{"paused": pause}, "sampling paused: %v", pause)
+   changeAll()
+   return true
 }
 
-func toggle(desc, val string) {
-   switch (val) {
-   case "on":
-      state(desc, true)
-   case "off":
-      state(desc, false)
-   default:
-      panic("unexpected state")
+// whether anything consumes samples without a client connected
+func samplesWanted() bool {
+   if *lazy {
+      return len(clients()) > 0
    }
 
-   // update all clients
-   for _, c := range connections {
-      change(*c)
-   }
+   return len(clients()) > 0 || *historyLen > 0 || *summaryWindow > 0 || *collector != ""
 }
 
-func monitor(w http.ResponseWriter, r *http.Request) {
-   socket, err := upgrader.Upgrade(w, r, nil)
-   if err != nil {
-      if *debug {
-         fmt.Print("upgrade:", err)
+// time until the first client wants a sample, at most the global interval so
+// labels and heartbeats are still handled
+func nextDue(t time.Time) time.Duration {
+   wait := time.Duration(intervalSetting()) * time.Millisecond
+
+   for _, c := range clients() {
+      if until := c.due.Sub(t); until < wait {
+         wait = until
       }
-      return
    }
 
-   defer socket.Close()
+   if wait < 0 {
+      return 0
+   }
 
-   c := Connection{socket: socket, mutex: &sync.Mutex{}}
+   return wait
+}
 
-   // handshake
-   _, message, err := c.socket.ReadMessage()
-   if err != nil {
-      if *debug {
-         fmt.Println("read:", err)
+// advances the timer of each client wanting a sample by t, returning whether any did
+func takeDue(t time.Time) bool {
+   wanted := false
+
+   for _, c := range clients() {
+      if c.due.After(t) {
+         continue
       }
-      return
+
+      // keep cadence, unless too far behind
+      c.due = c.due.Add(time.Duration(c.period()) * time.Millisecond)
+      if !c.due.After(t) {
+         c.due = t.Add(time.Duration(c.period()) * time.Millisecond)
+      }
+
+      wanted = true
+   }
+
+   return wanted
+}
+
+// reads all sensors, prefixed with the timestamp, with the layout to send them in
+// with -null-columns, as events may change before they are sent
+func sampleAll(timestamp int64) ([]int64, []int) {
+   sampling.Lock()
+   samples := []int64{timestamp}
+
+   for _, sensor := range present {
+      start := time.Now()
+      samples = append(samples, sensor.Sample()...)
+      sampled(sensor.Name(), time.Since(start))
    }
 
-   if string(message) != "463ba1974b06" {
-      if *debug {
-         fmt.Println("auth failed")
+   if *historyLen > 0 || *summaryWindow > 0 {
+      columns := headings()
+      floats := epochFloats(*discrete)
+
+      if *historyLen > 0 {
+         remember(columns, floats, samples)
+      }
+
+      if *summaryWindow > 0 {
+         summarise(columns, floats, samples)
       }
-      return
    }
 
-   if *debug {
-      fmt.Println("auth succeeded")
+   var layout []int
+   if *nullColumns {
+      layout = fullLayout(*discrete)
    }
 
-   msg := SignonMessage{
-      Timestamp: time.Now().UnixNano() / 1e3,
-      Tree: make(map[string][]string, len(present)),
-      Sources: make(map[string]uint, len(present)),
+   resets := takeResets()
+   sampling.Unlock()
+
+   // flushing the batch writes to clients, so not while holding up sampling
+   for _, name := range resets {
+      broadcastLabel(timestamp, "", name+" counter reset")
    }
 
-   msg.Tree = make(map[string][]string)
+   return samples, layout
+}
 
-   for _, sensor := range present {
-      name := sensor.Name()
-      events := sensor.Events()
+// discards a sample from each sensor so following values count from now
+func reset() {
+   sampling.Lock()
+   discardSamples()
+   sampling.Unlock()
 
-      msg.Tree[name] = make([]string, len(events))
-      msg.Sources[name] = sensor.Sources()
+   resetSummaries()
+   broadcastLabel(now(), "", "reset")
+}
 
-      for i, val := range events {
-         msg.Tree[name][i] = val.desc
-      }
+// sampling must be held
+func discardSamples() {
+   for _, sensor := range present {
+      sensor.Sample()
    }
+}
 
-   err = c.WriteJSON(&msg)
-   if err != nil {
-      if *debug {
-         fmt.Println("failed writing:", err)
-      }
-      return
+// effective interval for this connection in ms
+func (c *Connection) period() int {
+   c.mutex.Lock()
+   interval := c.interval
+   c.mutex.Unlock()
+
+   if interval > 0 {
+      return interval
    }
 
-   change(c);
-   connections = append(connections, &c)
+   return intervalSetting()
+}
 
-   for {
-      var msg map[string]string
-      err := c.socket.ReadJSON(&msg)
+// samples taken within the trailing window
+const achievedWindow = 10 * time.Second
 
-      if err != nil {
-         if *debug {
-            fmt.Println("failed reading:", err)
-         }
-         remove(c.socket)
-         break
-      }
+var (
+   sampleTimes   []time.Time
+   announced     float64 // achieved interval last sent to clients
+   announcedTime time.Time
+   achievedMutex sync.Mutex
+)
 
-      if *debug {
-         fmt.Printf("recv %#v\n", msg)
-      }
+// records when a sample was taken, telling clients if the achieved interval has drifted
+func noteSample(t time.Time) {
+   achievedMutex.Lock()
 
-      switch msg["Op"] {
-      case "update":
-         toggle(msg["Event"], msg["State"])
-      case "stop":
-         c.stopped = true
-      case "start":
-         c.stopped = false
-      case "averaging":
-         *discrete = msg["Value"] == "false"
-         Activate()
+   sampleTimes = append(sampleTimes, t)
+   for len(sampleTimes) > 0 && t.Sub(sampleTimes[0]) > achievedWindow {
+      sampleTimes = sampleTimes[1:]
+   }
 
-         for _, c2 := range connections {
-            change(*c2)
-         }
-      case "interval":
-         *interval, err = strconv.Atoi(msg["Value"])
-         if err != nil {
-            fmt.Printf("undefined value %v\n", msg["Value"])
-         }
-      default:
-         fmt.Printf("received unknown message %+v\n", msg)
-      }
+   achieved := achievedLocked()
+   drifted := t.Sub(announcedTime) >= achievedWindow && math.Abs(achieved - announced) > announced / 10
+   if drifted {
+      announced = achieved
+      announcedTime = t
+   }
+
+   achievedMutex.Unlock()
+
+   if drifted {
+      changeAll()
    }
 }
 
-func initweb(addr string) {
-   path := "/usr/local/share/numascope"
-   err := unix.Access(path, unix.R_OK)
-   if err != nil {
-      path = "resources"
-      err := unix.Access(path, unix.R_OK)
-      if err != nil {
-         panic("/usr/local/share/numascope or resources not present")
-      }
+// mean interval between recent samples in ms; achievedMutex must be held
+func achievedLocked() float64 {
+   n := len(sampleTimes)
+   if n < 2 {
+      return 0
    }
 
+   span := sampleTimes[n-1].Sub(sampleTimes[0])
+   return float64(span) / float64(time.Millisecond) / float64(n-1)
+}
+
+func achievedInterval() float64 {
+   achievedMutex.Lock()
+   defer achievedMutex.Unlock()
+
+   return achievedLocked()
+}
+
+// sample at the fastest rate any client wants
+func sampleInterval() int {
+   fastest := intervalSetting()
+
+   for i, c := range clients() {
+      if i == 0 || c.period() < fastest {
+         fastest = c.period()
+      }
+   }
+
+   return fastest
+}
+
+// drops epochs arriving faster than the connection's interval
+func (c *Connection) decimate(epochs [][]int64) [][]int64 {
+   period := c.period()
+
+   c.mutex.Lock()
+   defer c.mutex.Unlock()
+
+   out, last := thin(epochs, period, c.last)
+   c.last = last
+
+   return out
+}
+
+// drops epochs less than period ms after the one before, starting from timestamp last
+func thin(epochs [][]int64, period int, last int64) ([][]int64, int64) {
+   // tolerate sampling jitter
+   gap := int64(period) * 1e6 / timeUnit() * 9 / 10
+   var out [][]int64
+
+   for _, epoch := range epochs {
+      if epoch[0] - last >= gap {
+         out = append(out, epoch)
+         last = epoch[0]
+      }
+   }
+
+   return out, last
+}
+
+func (c *Connection) WriteJSON(msg interface{}) error {
+   debugf("broadcast", "-> %+v\n", msg)
+   c.trace("-> %+v", msg)
+
+   b, err := json.Marshal(msg)
+   if err != nil {
+      return err
+   }
+
+   return c.write(b)
+}
+
+func (c *Connection) write(b []byte) error {
+   c.mutex.Lock()
+
+   // small messages gain little and cost a compressor setup each
+   if *compressLevel > 0 {
+      c.socket.EnableWriteCompression(len(b) >= *compressMinBytes)
+   }
+
+   atomic.StoreInt64(&c.writing, time.Now().UnixNano())
+   err := c.socket.WriteMessage(websocket.TextMessage, b)
+   atomic.StoreInt64(&c.writing, 0)
+   drop := false
+
+   if err == nil {
+      c.lastWrite = time.Now()
+      c.failing = 0
+   } else {
+      c.failing++
+      drop = c.failing == c.maxFailures
+   }
+   failing := c.failing
+   c.mutex.Unlock()
+
+   if err != nil {
+      atomic.AddUint64(&c.failed, 1)
+      atomic.AddUint64(&failedWrites, 1)
+   }
+
+   // the reader in monitor() then fails and removes the connection
+   if drop {
+      c.logf("warn", logFields{"error": err.Error()}, "dropping client %s after %d consecutive failed writes", c.addr, failing)
+      c.socket.Close()
+   }
+
+   return err
+}
+
+// last resort for writes blocked on a wedged socket, which would hold up everyone else
+func watchdog() {
+   for {
+      time.Sleep(*writeStall / 4)
+      closeStalled(time.Now())
+   }
+}
+
+// closes connections whose current write began -write-stall before t, failing it;
+// returns how many
+func closeStalled(t time.Time) int {
+   closed := 0
+
+   for _, c := range clients() {
+      started := atomic.LoadInt64(&c.writing)
+      if started == 0 || t.Sub(time.Unix(0, started)) < *writeStall {
+         continue
+      }
+
+      // only once per stuck write
+      if !atomic.CompareAndSwapInt64(&c.writing, started, 0) {
+         continue
+      }
+
+      stuck := t.Sub(time.Unix(0, started)).Round(time.Second)
+      c.logf("warn", logFields{"stuck": stuck.String()}, "closing client %s, write blocked for %v", c.addr, stuck)
+      atomic.AddUint64(&forcedCloses, 1)
+      c.socket.Close()
+      closed++
+   }
+
+   return closed
+}
+
+func change(c *Connection) {
+   msg := ChangeMessage{
+      Op: "enabled",
+      Timestamp: now(),
+      Interval: c.period(),
+      Achieved: achievedInterval(),
+      Discrete: *discrete,
+      Columns: columns(*discrete),
+      Enabled: make(map[string][]string),
+      Index: make(map[string][]int),
+      SourceIndex: make(map[string][]int),
+      Clients: viewers(c),
+      Paused: isPaused(),
+   }
+
+   // column 0 is the timestamp
+   col := 1
+
+   // structure events into hashmap, in the order columns are sent
+   for _, o := range ordered(c.order) {
+      name := o.sensor.Name()
+      msg.Enabled[name] = make([]string, 0, 16)
+      msg.Index[name] = make([]int, 0, 16)
+      msg.SourceIndex[name] = sourceIndex(o.sensor)
+
+      width := eventWidth(o.sensor, *discrete)
+      events := o.sensor.Events()
+
+      for _, i := range o.events {
+         if events[i].enabled {
+            msg.Enabled[name] = append(msg.Enabled[name], events[i].desc)
+            msg.Index[name] = append(msg.Index[name], col)
+            col += width
+         }
+      }
+   }
+
+   err := c.WriteJSON(&msg)
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+   }
+}
+
+// update all clients
+func changeAll() {
+   for _, c := range clients() {
+      change(c)
+   }
+}
+
+// reassures clients which have had nothing recently that the connection is alive
+func heartbeat(timestamp int64) {
+   period := heartbeatSetting()
+   if period <= 0 {
+      return
+   }
+
+   msg := HeartbeatMessage{
+      Op: "heartbeat",
+      Timestamp: timestamp,
+      Columns: columns(*discrete),
+   }
+
+   for _, c := range clients() {
+      c.mutex.Lock()
+      idle := time.Since(c.lastWrite)
+      c.mutex.Unlock()
+
+      if idle < period {
+         continue
+      }
+
+      err := c.WriteJSON(&msg)
+      if err != nil {
+         c.debugln("broadcast", "failed writing:", err)
+      }
+   }
+}
+
+// sends a label after any batched samples, which were taken before it
+func broadcastLabel(timestamp int64, channel, label string) {
+   batchMutex.Lock()
+   defer batchMutex.Unlock()
+
+   flushLocked()
+
+   msg := LabelMessage{
+      Op: "label",
+      Timestamp: timestamp,
+      Label: label,
+      Channel: channel,
+   }
+
+   for _, c := range clients() {
+      err := c.WriteJSON(&msg)
+      if err != nil {
+         c.debugln("broadcast", "failed writing:", err)
+      }
+   }
+}
+
+// whether each value in epochs is fixed point, starting with the timestamp; nil if none are
+func epochFloats(discrete bool) []bool {
+   floats := []bool{false}
+   found := false
+
+   for _, sensor := range present {
+      for _, float := range sensorFloats(sensor, discrete) {
+         floats = append(floats, float)
+         found = found || float
+      }
+   }
+
+   if !found {
+      return nil
+   }
+
+   return floats
+}
+
+// maps every event in the signon tree to its column in epochs, starting with the timestamp
+func fullLayout(discrete bool) []int {
+   return orderedLayout(nil, discrete, true)
+}
+
+// names the sensor, event and source of each enabled column after the timestamp
+func verboseLayout(discrete bool) []verboseColumn {
+   var layout []verboseColumn
+
+   for _, sensor := range present {
+      for _, event := range sensor.Events() {
+         if !event.enabled {
+            continue
+         }
+
+         if !discrete {
+            layout = append(layout, verboseColumn{sensor.Name(), event.desc, "all"})
+            continue
+         }
+
+         for _, i := range sourceIndex(sensor) {
+            layout = append(layout, verboseColumn{sensor.Name(), event.desc, strconv.Itoa(i)})
+         }
+      }
+   }
+
+   return layout
+}
+
+// sends epochs to each connection wanting them; layout is that returned by sampleAll()
+func broadcastData(epochs [][]int64, layout []int) {
+   for _, c := range clients() {
+      if c.stopped || c.isFrozen() {
+         continue
+      }
+
+      selected := c.decimate(epochs)
+      if len(selected) == 0 {
+         continue
+      }
+
+      c.sendData(selected, layout)
+   }
+}
+
+// encodes epochs in the form this connection asked for and sends them
+func (c *Connection) sendData(epochs [][]int64, layout []int) {
+   floats := epochFloats(*discrete)
+
+   if c.order != nil {
+      layout = orderedLayout(c.order, *discrete, *nullColumns)
+   }
+
+   c.mutex.Lock()
+   digits := c.digits
+   c.mutex.Unlock()
+
+   var payload interface{} = &epochs
+   if c.verbose {
+      payload = verboseEpochs{epochs, verboseLayout(*discrete), digits, *safeIntegers, floats}
+   } else if layout != nil {
+      payload = fullEpochs{epochs, layout, digits, *safeIntegers, floats}
+   } else if digits > 0 || floats != nil {
+      payload = roundedEpochs{epochs, digits, *safeIntegers, floats}
+   } else if *safeIntegers {
+      payload = safeEpochs(epochs)
+   }
+
+   b, err := json.Marshal(payload)
+   validate(err)
+
+   framed(len(epochs), len(b))
+
+   c.mutex.Lock()
+   c.frame = b
+   if c.first == 0 {
+      c.first = epochs[0][0]
+   }
+   c.mutex.Unlock()
+
+   err = c.writeFrames(b)
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+   }
+}
+
+func (c *Connection) isFrozen() bool {
+   c.mutex.Lock()
+   defer c.mutex.Unlock()
+
+   return c.frozen
+}
+
+// stops sending this connection data, holding the last message sent
+func (c *Connection) freeze(frozen bool) {
+   c.mutex.Lock()
+   c.frozen = frozen
+   c.mutex.Unlock()
+}
+
+// sends the held data message again
+func (c *Connection) resendFrame() {
+   c.mutex.Lock()
+   frozen, frame := c.frozen, c.frame
+   c.mutex.Unlock()
+
+   if !frozen {
+      c.sendError(errInvalidValue, "not frozen")
+      return
+   }
+
+   if frame == nil {
+      c.sendError(errInvalidValue, "no data sent before freezing")
+      return
+   }
+
+   err := c.writeFrames(frame)
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+   }
+}
+
+// shortest time between samples a client can request with the sample op
+const sampleDebounce = time.Second
+
+// takes a sample immediately and sends it to this connection, and to others with their next batch
+func (c *Connection) sampleNow() {
+   // the held frame would be overwritten
+   if c.isFrozen() {
+      c.sendError(errInvalidValue, "frozen")
+      return
+   }
+
+   if time.Since(c.lastSample) < sampleDebounce {
+      c.sendError(errLimit, fmt.Sprintf("at most one sample request per %v", sampleDebounce))
+      return
+   }
+
+   c.lastSample = time.Now()
+
+   if isPaused() {
+      c.sendError(errInvalidValue, "sampling is paused")
+      return
+   }
+
+   if columns(*discrete) == 0 {
+      return
+   }
+
+   samples, layout := sampleAll(now())
+
+   // the baselines moved, so others count from this sample too, when their batch is sent
+   batchMutex.Lock()
+   defer batchMutex.Unlock()
+
+   if !equalInts(layout, batchLayout) {
+      flushLocked()
+   }
+
+   // this connection gets the samples batched before it now, so none are skipped;
+   // having advanced its last timestamp, they aren't sent to it again with the batch
+   selected := append(c.decimate(batch), samples)
+   batch = append(batch, samples)
+   batchLayout = layout
+
+   c.mutex.Lock()
+   c.last = samples[0]
+   c.mutex.Unlock()
+
+   c.sendData(selected, layout)
+}
+
+// writes a data message, split into continuation messages if over the frame size limit
+func (c *Connection) writeFrames(b []byte) error {
+   debugf("broadcast", "-> %s\n", b)
+   c.trace("-> %s", b)
+
+   if *maxFrameBytes == 0 || len(b) <= *maxFrameBytes {
+      return c.write(b)
+   }
+
+   // leave room for the envelope and any escaped quotes
+   chunk := *maxFrameBytes - 64
+   if bytes.IndexByte(b, '"') >= 0 {
+      chunk /= 2
+   }
+
+   for len(b) > 0 {
+      n := chunk
+      if n > len(b) {
+         n = len(b)
+      }
+
+      msg := ContinuedMessage{
+         Op: "continued",
+         More: n < len(b),
+         Data: string(b[:n]),
+      }
+
+      frame, err := json.Marshal(&msg)
+      if err != nil {
+         return err
+      }
+
+      err = c.write(frame)
+      if err != nil {
+         return err
+      }
+
+      b = b[n:]
+   }
+
+   return nil
+}
+
+func remove(c transport) {
+   connMutex.Lock()
+   defer connMutex.Unlock()
+
+   for i := range connections {
+      if connections[i].socket == c {
+         connections[i] = connections[len(connections)-1]
+         connections = connections[:len(connections)-1]
+         return
+      }
+   }
+
+   // already removed, eg by a test resetting connections
+}
+
+// number of values in each epoch, excluding the timestamp
+func columns(discrete bool) int {
+   total := 0
+
+   for _, sensor := range present {
+      total += width(sensor, discrete)
+   }
+
+   return total
+}
+
+// number of values a sensor's samples should have
+func width(sensor Sensor, discrete bool) int {
+   n := 0
+
+   for _, event := range sensor.Events() {
+      if event.enabled {
+         n++
+      }
+   }
+
+   if discrete {
+      n *= int(sensor.Sources())
+   }
+
+   return n
+}
+
+// samples each sensor, checking it returns a value for each enabled event and source,
+// as a sensor returning too few or many would misalign the columns of those after it
+func checkWidths() error {
+   sampling.Lock()
+   defer sampling.Unlock()
+
+   for _, sensor := range present {
+      want := width(sensor, *discrete)
+
+      got := len(sensor.Sample())
+      if got != want {
+         return fmt.Errorf("%s returned %d values, expected %d", sensor.Name(), got, want)
+      }
+
+      got = len(sensor.Headings(false))
+      if got != want {
+         return fmt.Errorf("%s has %d headings, expected %d", sensor.Name(), got, want)
+      }
+   }
+
+   return nil
+}
+
+func overLimit(discrete bool) bool {
+   return *maxColumns > 0 && columns(discrete) > *maxColumns
+}
+
+// applies changed events to a locked sensor, restoring the previous events if it refuses
+func enable(sensor Sensor, previous []bool) *opError {
+   err := sensor.Enable(*discrete)
+   if err == nil {
+      return nil
+   }
+
+   events := sensor.Events()
+   for i := range events {
+      events[i].enabled = previous[i]
+   }
+
+   // previously accepted, so can't fail
+   _ = sensor.Enable(*discrete)
+
+   return &opError{errSensor, fmt.Sprintf("%s: %v", sensor.Name(), err)}
+}
+
+// initialises the baseline of newly enabled events for sensors which can't do so
+// in Enable(), returning whether events already enabled may show a discontinuity
+func rebaseline(sensor Sensor, previous []bool) bool {
+   if h, ok := sensor.(hotEnabler); ok && h.HotEnable() {
+      return false
+   }
+
+   // discard values to initialise last
+   sensor.Sample()
+
+   events := sensor.Events()
+   for i := range events {
+      if previous[i] && events[i].enabled {
+         return true
+      }
+   }
+
+   return false
+}
+
+// labels the possible discontinuity in the events of sensors rebaselined
+func labelReconfigured(sensors []string) {
+   for _, name := range sensors {
+      broadcastLabel(now(), "", name+" reconfigured")
+   }
+}
+
+func state(desc string, state bool) *opError {
+   // labelled once sampling is unlocked, as flushing the batch writes to clients
+   var reconfigured []string
+   defer func() { labelReconfigured(reconfigured) }()
+
+   sampling.Lock()
+   defer sampling.Unlock()
+
+   for _, sensor := range present {
+      events := sensor.Events()
+      sensor.Lock()
+
+      // check if 'all' button was selected
+      if desc == /*sensor.Name() +*/ "all" {
+         previous := make([]bool, len(events))
+
+         for i := range events {
+            previous[i] = events[i].enabled
+            events[i].enabled = true
+         }
+
+         if overLimit(*discrete) {
+            for i := range events {
+               events[i].enabled = previous[i]
+            }
+
+            sensor.Unlock()
+            return &opError{errLimit, fmt.Sprintf("enabling all %s events would exceed the limit of %d columns", sensor.Name(), *maxColumns)}
+         }
+
+         err := enable(sensor, previous)
+         sensor.Unlock()
+         if err != nil {
+            return err
+         }
+
+         if rebaseline(sensor, previous) {
+            reconfigured = append(reconfigured, sensor.Name())
+         }
+         return nil
+      }
+
+      for i := range events {
+         if events[i].desc == desc {
+            previous := make([]bool, len(events))
+            for j := range events {
+               previous[j] = events[j].enabled
+            }
+
+            events[i].enabled = state
+
+            if overLimit(*discrete) {
+               events[i].enabled = previous[i]
+               sensor.Unlock()
+               return &opError{errLimit, fmt.Sprintf("enabling '%s' would exceed the limit of %d columns", desc, *maxColumns)}
+            }
+
+            err := enable(sensor, previous)
+            sensor.Unlock()
+            if err != nil {
+               return err
+            }
+
+            if rebaseline(sensor, previous) {
+               reconfigured = append(reconfigured, sensor.Name())
+            }
+            return nil
+         }
+      }
+
+      sensor.Unlock()
+   }
+
+   return &opError{errUnknownEvent, "event '"+desc+"' not found"}
+}
+
+// reports an error caused by this client to it alone
+func (c *Connection) sendError(code, message string) {
+   msg := ErrorMessage{
+      Op: "error",
+      Code: code,
+      Message: message,
+   }
+
+   err := c.WriteJSON(&msg)
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+   }
+}
+
+// reports an error affecting all clients
+func broadcastError(code, message string) {
+   for _, c := range clients() {
+      c.sendError(code, message)
+   }
+}
+
+// sets the state of all events whose descriptions match a glob pattern, returning how many matched
+func statePattern(pattern string, state bool) (int, *opError) {
+   pattern = strings.ToLower(pattern)
+
+   if _, err := path.Match(pattern, ""); err != nil {
+      return 0, &opError{errInvalidValue, "invalid pattern '"+pattern+"'"}
+   }
+
+   var reconfigured []string
+   defer func() { labelReconfigured(reconfigured) }()
+
+   sampling.Lock()
+   defer sampling.Unlock()
+
+   matched := 0
+   previous := make([][]bool, len(present))
+   touched := make([]bool, len(present))
+
+   for i, sensor := range present {
+      events := sensor.Events()
+      previous[i] = make([]bool, len(events))
+      sensor.Lock()
+
+      for j := range events {
+         previous[i][j] = events[j].enabled
+
+         if ok, _ := path.Match(pattern, strings.ToLower(events[j].desc)); ok {
+            events[j].enabled = state
+            touched[i] = true
+            matched++
+         }
+      }
+   }
+
+   var err *opError
+
+   if matched == 0 {
+      err = &opError{errUnknownEvent, "no events match '"+pattern+"'"}
+   } else if overLimit(*discrete) {
+      err = &opError{errLimit, fmt.Sprintf("enabling events matching '%s' would exceed the limit of %d columns", pattern, *maxColumns)}
+   }
+
+   for i, sensor := range present {
+      if err != nil {
+         events := sensor.Events()
+
+         for j := range events {
+            events[j].enabled = previous[i][j]
+         }
+      } else if touched[i] {
+         err = enable(sensor, previous[i])
+
+         // later sensors are restored too
+         touched[i] = err == nil
+      }
+
+      sensor.Unlock()
+
+      if err == nil && touched[i] && rebaseline(sensor, previous[i]) {
+         reconfigured = append(reconfigured, sensor.Name())
+      }
+   }
+
+   return matched, err
+}
+
+func togglePattern(c *Connection, pattern, val string) {
+   var matched int
+   var err *opError
+
+   switch (val) {
+   case "on":
+      matched, err = statePattern(pattern, true)
+   case "off":
+      matched, err = statePattern(pattern, false)
+   default:
+      err = &opError{errInvalidValue, "unexpected state '"+val+"'"}
+   }
+
+   if err != nil {
+      c.sendError(err.code, err.message)
+
+      // sensors before the one which failed keep their changes
+      if err.code == errSensor {
+         changeAll()
+      }
+      return
+   }
+
+   msg := PatternMessage{
+      Op: "pattern",
+      Pattern: pattern,
+      Matched: matched,
+   }
+
+   werr := c.WriteJSON(&msg)
+   if werr != nil {
+      c.debugln("broadcast", "failed writing:", werr)
+   }
+
+   changeAll()
+}
+
+// reports the effective settings and sampling costs
+func sendConfig(c *Connection) {
+   msg := ConfigMessage{
+      Op: "config",
+      Settings: make(map[string]string),
+      Sampling: samplingCosts(),
+   }
+
+   settingsMutex.RLock()
+   flag.VisitAll(func(f *flag.Flag) {
+      if !credentials[f.Name] {
+         msg.Settings[f.Name] = f.Value.String()
+      }
+   })
+   settingsMutex.RUnlock()
+
+   err := c.WriteJSON(&msg)
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+   }
+}
+
+func toggle(c *Connection, desc, val string) {
+   var err *opError
+
+   switch (val) {
+   case "on":
+      err = state(desc, true)
+   case "off":
+      err = state(desc, false)
+   default:
+      err = &opError{errInvalidValue, "unexpected state '"+val+"'"}
+   }
+
+   if err != nil {
+      c.logf("warn", logFields{"code": err.code, "error": err.message}, "rejected update: %v", err)
+      c.sendError(err.code, err.message)
+      return
+   }
+
+   changeAll()
+}
+
+// whether a string matches a pattern where * matches any run of characters
+func globMatch(pattern, s string) bool {
+   parts := strings.Split(pattern, "*")
+   if !strings.HasPrefix(s, parts[0]) {
+      return false
+   }
+   s = s[len(parts[0]):]
+
+   for i, part := range parts[1:] {
+      if i == len(parts)-2 {
+         return strings.HasSuffix(s, part)
+      }
+
+      n := strings.Index(s, part)
+      if n < 0 {
+         return false
+      }
+      s = s[n+len(part):]
+   }
+
+   return s == ""
+}
+
+// whether val matches any of a comma-separated list of patterns
+func allowed(list, val string) bool {
+   for _, pattern := range strings.Split(list, ",") {
+      if globMatch(strings.TrimSpace(pattern), val) {
+         return true
+      }
+   }
+
+   return false
+}
+
+// why a websocket request is refused by -allow-origins or -allow-user-agents, if it is
+func disallowed(r *http.Request) string {
+   if *allowOrigins != "" && !allowed(*allowOrigins, r.Header.Get("Origin")) {
+      rejected("origin")
+      return "origin not allowed"
+   }
+
+   if *allowAgents != "" && !allowed(*allowAgents, r.Header.Get("User-Agent")) {
+      rejected("user-agent")
+      return "user agent not allowed"
+   }
+
+   return ""
+}
+
+// applies the flags given after the token, or in the URL
+func (c *Connection) handshakeFlags(fields []string) {
+   for _, field := range fields {
+      if list, ok := strings.CutPrefix(field, "order="); ok {
+         c.order = parseOrder(list)
+         continue
+      }
+
+      switch field {
+      case "verbose":
+         c.verbose = true
+      case "chunked":
+         c.chunked = true
+      default:
+         c.debugln("ws", "ignoring unknown handshake flag", field)
+      }
+   }
+}
+
+func monitor(w http.ResponseWriter, r *http.Request) {
+   presented, byHeader := bearer(r)
+   if *handshakeAuth == "message" {
+      byHeader = false
+   }
+
+   // refused before upgrading, as gateways expect
+   if (*handshakeAuth == "header" && !byHeader) || (byHeader && !authorized(r)) {
+      debugln("ws", "header auth failed from", r.RemoteAddr)
+      authFailed(r.RemoteAddr)
+      w.Header().Set("WWW-Authenticate", "Bearer")
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   socket, err := upgrader.Upgrade(w, r, nil)
+   if err != nil {
+      debugln("ws", "upgrade:", err)
+      return
+   }
+
+   defer socket.Close()
+
+   // holds for the handshake and every request after, so a huge one isn't buffered
+   socket.SetReadLimit(*maxRequest)
+
+   if reason := disallowed(r); reason != "" {
+      debugln("ws", "rejected", r.RemoteAddr+":", reason)
+      closeRetry(socket, websocket.ClosePolicyViolation, reason, 60*time.Second)
+      return
+   }
+
+   // clients sending no subprotocol are accepted as before
+   if len(websocket.Subprotocols(r)) > 0 && socket.Subprotocol() == "" {
+      debugln("ws", "unsupported subprotocols", websocket.Subprotocols(r))
+      closeRetry(socket, websocket.CloseProtocolError, "unsupported subprotocol, expected "+subprotocol, 0)
+      return
+   }
+
+   if *compressLevel > 0 {
+      socket.EnableWriteCompression(true)
+      err = socket.SetCompressionLevel(*compressLevel)
+      validate(err)
+   }
+
+   c := Connection{socket: socket, mutex: &sync.Mutex{}, addr: r.RemoteAddr, session: newSessionID(), id: newConnID(), maxFailures: *maxWriteFailures}
+
+   var fields []string
+
+   if byHeader {
+      // no handshake message, so flags are in the URL
+      fields = strings.Fields(r.URL.Query().Get("flags"))
+   } else {
+      _, message, err := c.socket.ReadMessage()
+      if err != nil {
+         c.debugln("ws", "read:", err)
+         return
+      }
+
+      // the token may be followed by space-separated flags
+      fields = strings.Fields(string(message))
+      presented = ""
+      if len(fields) > 0 {
+         presented = fields[0]
+         fields = fields[1:]
+      }
+   }
+
+   c.handshakeFlags(fields)
+   tok, spectator := tokenSettings()
+   c.spectator = spectator != "" && tokenMatches(presented, spectator)
+
+   if !c.spectator && !tokenMatches(presented, tok) {
+      c.debugln("ws", "auth failed")
+      authFailed(c.addr)
+      closeRetry(socket, websocket.ClosePolicyViolation, "authentication failed", 60*time.Second)
+      return
+   }
+
+   c.debugln("ws", "auth succeeded")
+
+   if !c.reserve() {
+      closeRetry(socket, websocket.CloseTryAgainLater, "too many connections", 30*time.Second)
+      return
+   }
+   defer c.unreserve()
+
+   serve(&c)
+}
+
+// display hints configured for an event, or nil
+func hints(event Event) map[string]string {
+   if h, ok := eventHints[event.mnemonic]; ok {
+      return h
+   }
+
+   return eventHints[event.desc]
+}
+
+// sends the sensor tree in parts of at most -signon-chunk events, then marks the end
+func (c *Connection) sendSignonParts() error {
+   for _, o := range ordered(c.order) {
+      sensor := o.sensor
+      events := sensor.Events()
+      types := eventTypes(sensor)
+
+      for offset := 0; offset == 0 || offset < len(events); offset += *signonChunk {
+         end := offset + *signonChunk
+         if end > len(events) {
+            end = len(events)
+         }
+
+         part := SignonPart{
+            Op: "signon-part",
+            Sensor: sensor.Name(),
+            Offset: offset,
+            Events: make([]string, 0, end-offset),
+            Sources: sensor.Sources(),
+            Config: sensor.Config(),
+            Weights: weights(sensor),
+         }
+
+         for _, i := range o.events[offset:end] {
+            part.Events = append(part.Events, events[i].desc)
+            part.Types = append(part.Types, types[i].String())
+
+            if h := hints(events[i]); h != nil {
+               if part.Hints == nil {
+                  part.Hints = make(map[string]map[string]string)
+               }
+               part.Hints[events[i].desc] = h
+            }
+         }
+
+         err := c.WriteJSON(&part)
+         if err != nil {
+            return err
+         }
+      }
+   }
+
+   return c.WriteJSON(&struct{ Op string }{"signon-complete"})
+}
+
+// sends the signon and change messages, then handles requests until the connection
+// closes, returning why
+func serve(c *Connection) error {
+   socket := c.socket
+
+   mode := *coalesceMode
+   if noCoalescing() {
+      mode = "none"
+   }
+
+   msg := SignonMessage{
+      Version: protocolVersion,
+      Timestamp: now(),
+      Precision: *timePrecision,
+      Clock:     *clock,
+      Origin:    origin(),
+      MaxColumns: *maxColumns,
+      SafeIntegers: *safeIntegers,
+      Coalesce: mode,
+      Session: c.session,
+      NullColumns: *nullColumns,
+      Spectator: c.spectator,
+      Verbose: c.verbose,
+      Connection: c.id,
+      Host: hostname(),
+      NodeName: *nodeName,
+      MachineID: machineID(),
+      Capabilities: capabilities(),
+   }
+
+   sensors := ordered(c.order)
+   total := 0
+
+   for _, o := range sensors {
+      msg.Order = append(msg.Order, o.sensor.Name())
+      total += len(o.events)
+   }
+
+   // avoids building the whole tree at once
+   msg.Chunked = c.chunked && total > *signonChunk
+
+   if !msg.Chunked {
+      msg.Tree = make(map[string][]string, len(present))
+      msg.Sources = make(map[string]uint, len(present))
+      msg.Config = make(map[string]map[string]string, len(present))
+      msg.Types = make(map[string][]string, len(present))
+   }
+
+   for _, o := range sensors {
+      if msg.Chunked {
+         break
+      }
+
+      sensor := o.sensor
+      name := sensor.Name()
+      events := sensor.Events()
+      types := eventTypes(sensor)
+
+      msg.Tree[name] = make([]string, len(events))
+      msg.Sources[name] = sensor.Sources()
+      msg.Config[name] = sensor.Config()
+
+      if w := weights(sensor); w != nil {
+         if msg.Weights == nil {
+            msg.Weights = make(map[string][]float64)
+         }
+         msg.Weights[name] = w
+      }
+
+      for j, i := range o.events {
+         val := events[i]
+         msg.Tree[name][j] = val.desc
+         msg.Types[name] = append(msg.Types[name], types[i].String())
+
+         if h := hints(val); h != nil {
+            if msg.Hints == nil {
+               msg.Hints = make(map[string]map[string]map[string]string)
+            }
+            if msg.Hints[name] == nil {
+               msg.Hints[name] = make(map[string]map[string]string)
+            }
+            msg.Hints[name][val.desc] = h
+         }
+      }
+   }
+
+   // a client which won't read mustn't hold this goroutine during setup
+   if *signonTimeout > 0 {
+      err := socket.SetWriteDeadline(time.Now().Add(*signonTimeout))
+      if err != nil {
+         c.logf("warn", logFields{"error": err.Error()}, "setting signon deadline for %s failed: %v", c.addr, err)
+         socket.Close()
+         return err
+      }
+   }
+
+   err := c.WriteJSON(&msg)
+   if err == nil && msg.Chunked {
+      err = c.sendSignonParts()
+   }
+
+   if err != nil {
+      c.debugln("ws", "failed writing:", err)
+      closeRetry(socket, websocket.CloseGoingAway, "signon not accepted", 0)
+      return err
+   }
+
+   change(c)
+
+   if atomic.LoadUint64(&c.failed) > 0 {
+      closeRetry(socket, websocket.CloseGoingAway, "signon not accepted", 0)
+      return fmt.Errorf("signon not accepted")
+   }
+
+   // the connection may have failed since
+   err = socket.SetWriteDeadline(time.Time{})
+   if err != nil {
+      c.logf("warn", logFields{"error": err.Error()}, "clearing signon deadline for %s failed: %v", c.addr, err)
+      socket.Close()
+      return err
+   }
+
+   connMutex.Lock()
+   connections = append(connections, c)
+   c.unreserveLocked()
+   others := append([]*Connection(nil), connections[:len(connections)-1]...)
+   connMutex.Unlock()
+
+   c.logf("info", logFields{}, "client %s connected", c.addr)
+
+   // let everyone else see the new viewer
+   for _, other := range others {
+      change(other)
+   }
+
+   for {
+      _, message, err := c.socket.ReadMessage()
+
+      if err != nil {
+         c.debugln("ws", "failed reading:", err)
+         remove(c.socket)
+         saveSession(c)
+         c.logf("info", logFields{}, "client %s disconnected", c.addr)
+         changeAll()
+         return err
+      }
+
+      // a bad message is the client's mistake, not a reason to disconnect
+      var msg map[string]string
+      err = json.Unmarshal(message, &msg)
+      if err != nil {
+         c.debugln("ws", "malformed request:", err)
+         c.sendError(errMalformed, fmt.Sprintf("malformed request: %v", err))
+         continue
+      }
+
+      c.debugf("ws", "recv %#v\n", msg)
+      c.trace("recv %#v", msg)
+
+      if c.spectator && mutating[msg["Op"]] {
+         c.sendError(errForbidden, fmt.Sprintf("spectators can't use op '%s'", msg["Op"]))
+         continue
+      }
+
+      op := msg["Op"]
+      start := time.Now()
+
+      switch msg["Op"] {
+      case "update":
+         toggle(c, msg["Event"], msg["State"])
+      case "pattern":
+         togglePattern(c, msg["Pattern"], msg["State"])
+      case "mask":
+         err := maskSources(msg["Sensor"], msg["Value"])
+         if err != nil {
+            c.logf("warn", logFields{"code": err.code, "error": err.message}, "rejected mask: %v", err)
+            c.sendError(err.code, err.message)
+            break
+         }
+
+         changeAll()
+      case "config":
+         sendConfig(c)
+      case "resume":
+         // anything already sent to this connection needn't be backfilled
+         c.mutex.Lock()
+         first, sent := c.first, c.last
+         resumed := resumeSession(c, msg["Session"])
+         from := c.last
+         if first != 0 {
+            c.last = sent
+         }
+         c.mutex.Unlock()
+
+         if !resumed {
+            c.sendError(errInvalidValue, "unknown or expired session")
+            break
+         }
+
+         change(c)
+         c.backfill(from, first)
+      case "sample":
+         c.sampleNow()
+      case "pause-sampling", "resume-sampling":
+         if !pauseSampling(msg["Op"] == "pause-sampling") {
+            state := "running"
+            if isPaused() {
+               state = "paused"
+            }
+
+            c.sendError(errInvalidValue, "sampling already "+state)
+         }
+      case "summary":
+         if *summaryWindow <= 0 {
+            c.sendError(errInvalidValue, "summaries disabled")
+            break
+         }
+
+         msg := summaries()
+         err := c.WriteJSON(&msg)
+         if err != nil {
+            c.debugln("ws", "failed writing summary:", err)
+         }
+      case "reset":
+         reset()
+      case "stop":
+         c.stopped = true
+      case "start":
+         c.stopped = false
+      case "freeze":
+         c.freeze(true)
+      case "unfreeze":
+         c.freeze(false)
+      case "frame":
+         c.resendFrame()
+      case "averaging":
+         val := msg["Value"] == "false"
+
+         if val && overLimit(val) {
+            c.sendError(errLimit, fmt.Sprintf("per-unit values would exceed the limit of %d columns", *maxColumns))
+            break
+         }
+
+         *discrete = val
+
+         err := Activate()
+         if err != nil {
+            // return to the mode the sensors accepted
+            *discrete = !val
+            _ = Activate()
+
+            c.sendError(errSensor, err.Error())
+            break
+         }
+
+         changeAll()
+      case "interval":
+         val, err := strconv.Atoi(msg["Value"])
+         if err != nil || val < 1 {
+            c.sendError(errInvalidValue, fmt.Sprintf("invalid interval '%s'", msg["Value"]))
+            break
+         }
+
+         if val < minInterval {
+            c.sendError(errLimit, fmt.Sprintf("interval %dms is below the minimum of %dms", val, minInterval))
+            break
+         }
+
+         c.mutex.Lock()
+         c.interval = val
+         c.mutex.Unlock()
+
+         change(c)
+      case "digits":
+         val, err := strconv.Atoi(msg["Value"])
+         if err != nil || val < 0 || val > 17 {
+            c.sendError(errInvalidValue, fmt.Sprintf("invalid digits '%s'", msg["Value"]))
+            break
+         }
+
+         c.mutex.Lock()
+         c.digits = val
+         c.mutex.Unlock()
+      default:
+         op = "unknown"
+         c.sendError(errUnknownOp, fmt.Sprintf("unknown op '%s'", msg["Op"]))
+      }
+
+      handled(op, time.Since(start))
+   }
+}
+
+// resolves the directory of web interface files to an absolute path, trying the
+// default locations if none is given, and reporting why each was unusable
+func resourcesDir(dir, root string) (string, error) {
+   candidates := []string{dir}
+   if dir == "" {
+      candidates = []string{"/usr/local/share/numascope", "resources"}
+   }
+
+   var problems []string
+
+   for _, candidate := range candidates {
+      abs, err := checkResources(candidate, root)
+      if err == nil {
+         return abs, nil
+      }
+
+      problems = append(problems, err.Error())
+   }
+
+   return "", fmt.Errorf("no usable web interface directory: %s", strings.Join(problems, "; "))
+}
+
+// describes why a path couldn't be used
+func pathProblem(path string, err error) error {
+   switch {
+   case errors.Is(err, fs.ErrNotExist):
+      return fmt.Errorf("%s: not found", path)
+   case errors.Is(err, fs.ErrPermission):
+      return fmt.Errorf("%s: permission denied", path)
+   }
+
+   return fmt.Errorf("%s: %v", path, err)
+}
+
+// checks a directory is under root, if given, and can be listed, by opening it
+// rather than probing permissions which may not match what serving it meets
+func checkResources(dir, root string) (string, error) {
+   abs, err := filepath.Abs(dir)
+   if err != nil {
+      return "", pathProblem(dir, err)
+   }
+
+   abs, err = filepath.EvalSymlinks(abs)
+   if err != nil {
+      return "", pathProblem(dir, err)
+   }
+
+   f, err := os.Open(abs)
+   if err != nil {
+      return "", pathProblem(abs, err)
+   }
+   defer f.Close()
+
+   info, err := f.Stat()
+   if err != nil {
+      return "", pathProblem(abs, err)
+   }
+
+   if !info.IsDir() {
+      return "", fmt.Errorf("%s: not a directory", abs)
+   }
+
+   _, err = f.Readdirnames(1)
+   if err != nil && err != io.EOF {
+      return "", pathProblem(abs, err)
+   }
+
+   if root != "" {
+      root, err = filepath.Abs(root)
+      if err != nil {
+         return "", pathProblem(root, err)
+      }
+
+      root, err = filepath.EvalSymlinks(root)
+      if err != nil {
+         return "", pathProblem(root, err)
+      }
+
+      rel, err := filepath.Rel(root, abs)
+      if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+         return "", fmt.Errorf("%s: outside %s", abs, root)
+      }
+   }
+
+   return abs, nil
+}
+
+func initweb(addr string) {
+   path, err := resourcesDir(*resources, *resourcesRoot)
+   validate(err)
+
+   logf("info", logFields{"path": path}, "serving web interface from %s", path)
+
+   // only used if the client also offers permessage-deflate
+   upgrader.EnableCompression = *compressLevel > 0
+
+   // checked after upgrading instead, so the client learns why it was refused
+   if *allowOrigins != "" {
+      upgrader.CheckOrigin = func(r *http.Request) bool {
+         return true
+      }
+   }
+
+   // not the default mux, which net/http/pprof registers on
+   mux := http.NewServeMux()
+   base := *basePath
    fileServer := http.FileServer(http.Dir(path))
-   http.Handle("/", fileServer)
-   http.HandleFunc("/monitor", monitor)
+   mux.Handle(base+"/", http.StripPrefix(base, fileServer))
+   mux.HandleFunc(base+"/monitor", monitor)
+
+   if *metricsListen == "" {
+      mux.HandleFunc(base+"/healthz", requireMetricsAuth(healthz))
+      mux.HandleFunc(base+"/metrics", requireMetricsAuth(metrics))
+   } else {
+      initMetrics(*metricsListen)
+   }
+
+   mux.HandleFunc(base+"/trace", traceClient)
+   mux.HandleFunc(base+"/grafana/", grafanaRoot)
+   mux.HandleFunc(base+"/grafana/search", grafanaTargets)
+   mux.HandleFunc(base+"/grafana/query", grafanaData)
+   mux.HandleFunc(base+"/summary", summaryEndpoint)
+   mux.HandleFunc(base+"/capabilities", capabilitiesEndpoint)
+   mux.HandleFunc(base+"/stream", stream)
+   server.RegisterOnShutdown(closeStreams)
+
+   if sock, ok := strings.CutPrefix(addr, "unix:"); ok {
+      // remove any socket left by a previous run, but nothing else at that path
+      if info, err := os.Lstat(sock); err == nil {
+         if info.Mode().Type() != os.ModeSocket {
+            validate(fmt.Errorf("%s exists and isn't a socket", sock))
+         }
+
+         _ = os.Remove(sock)
+      }
+
+      l, err := net.Listen("unix", sock)
+      validate(err)
+
+      server.Handler = mux
+      setTimeouts(server)
+      go server.Serve(l)
+      logf("info", logFields{"socket": sock}, "web interface available on socket %s", sock)
+      return
+   }
+
+   // detects clients whose host died without closing the connection
+   lc := net.ListenConfig{KeepAlive: *tcpKeepalive}
+   l, err := lc.Listen(context.Background(), "tcp", addr)
+   validate(err)
+
+   server.Handler = mux
+   setTimeouts(server)
+   go server.Serve(l)
+   url := displayURL(addr) + strings.TrimPrefix(base+"/", "/")
+   logf("info", logFields{"url": url}, "web interface available at %s", url)
+}
+
+// stops slow or idle clients holding connections open; upgraded websockets have
+// the deadlines cleared, so are unaffected
+func setTimeouts(s *http.Server) {
+   s.ReadHeaderTimeout = *readHeaderTimeout
+   s.ReadTimeout = *readTimeout
+   s.IdleTimeout = *idleTimeout
+}
+
+// a URL a browser on this host can open for the listen address
+func displayURL(addr string) string {
+   host, port, err := net.SplitHostPort(addr)
+   if err != nil {
+      return "http://" + addr
+   }
+
+   // wildcard binds are reachable locally
+   ip := net.ParseIP(host)
+   if host == "" || (ip != nil && ip.IsUnspecified()) {
+      host = "localhost"
+   }
+
+   if port == "80" || port == "http" {
+      if strings.Contains(host, ":") {
+         return "http://[" + host + "]/"
+      }
+
+      return "http://" + host + "/"
+   }
 
-   go http.ListenAndServe(addr, nil)
-   port := strings.Split(addr, ":")[1]
-   fmt.Printf("web interface available on port %s\n", port)
+   return "http://" + net.JoinHostPort(host, port) + "/"
 }
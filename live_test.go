@@ -0,0 +1,1209 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "context"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "net/http"
+   "net/http/httptest"
+   "os"
+   "path/filepath"
+   "reflect"
+   "runtime"
+   "strings"
+   "sync"
+   "sync/atomic"
+   "testing"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// sensor producing an incrementing count for each enabled event
+type fakeSensor struct {
+   events   []Event
+   sources  uint
+   discrete bool
+   primed   bool // false until a sample after enabling initialises the baseline
+   nEnabled int
+   count    int64
+   reject   bool // fail enabling per-unit values
+   mutex    sync.Mutex
+}
+
+func newFakeSensor() *fakeSensor {
+   return &fakeSensor{
+      events: []Event{
+         {-1, "fake0", "fake event 0", false, 64},
+         {-1, "fake1", "fake event 1", false, 64},
+         {-1, "fake2", "fake event 2", false, 64},
+      },
+      sources: 2,
+   }
+}
+
+func (d *fakeSensor) Name() string {
+   return "fake"
+}
+
+func (d *fakeSensor) Present() bool {
+   return true
+}
+
+func (d *fakeSensor) Rate() uint {
+   return 0
+}
+
+func (d *fakeSensor) Sources() uint {
+   return d.sources
+}
+
+func (d *fakeSensor) Events() []Event {
+   return d.events
+}
+
+func (d *fakeSensor) Configure(options map[string]string) error {
+   return nil
+}
+
+func (d *fakeSensor) Config() map[string]string {
+   return map[string]string{}
+}
+
+func (d *fakeSensor) Lock() {
+   d.mutex.Lock()
+}
+
+func (d *fakeSensor) Unlock() {
+   d.mutex.Unlock()
+
+   // widen race windows, even on one processor
+   runtime.Gosched()
+}
+
+func (d *fakeSensor) Enable(discrete bool) error {
+   if d.reject && discrete {
+      return fmt.Errorf("per-unit values unsupported")
+   }
+
+   d.discrete = discrete
+   d.primed = false
+   d.nEnabled = 0
+
+   for _, event := range d.events {
+      if event.enabled {
+         d.nEnabled++
+      }
+   }
+
+   return nil
+}
+
+func (d *fakeSensor) Headings(mnemonics bool) []string {
+   var headings []string
+
+   for _, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      if !d.discrete {
+         headings = append(headings, event.mnemonic)
+         continue
+      }
+
+      for i := uint(0); i < d.sources; i++ {
+         headings = append(headings, fmt.Sprintf("%s:%d", event.mnemonic, i))
+      }
+   }
+
+   return headings
+}
+
+func (d *fakeSensor) Sample() []int64 {
+   d.Lock()
+   defer d.Unlock()
+
+   n := d.nEnabled
+   if d.discrete {
+      n *= int(d.sources)
+   }
+
+   samples := make([]int64, n)
+   for i := range samples {
+      d.count++
+      samples[i] = d.count
+
+      // meaningless without a baseline
+      if !d.primed {
+         samples[i] = -1
+      }
+   }
+
+   d.primed = true
+   return samples
+}
+
+// forgets connections left by earlier tests, which may still be disconnecting
+// also drops samples batched for earlier connections
+func resetConnections() {
+   connMutex.Lock()
+   connections = nil
+   connMutex.Unlock()
+
+   batchMutex.Lock()
+   batch, batchLayout = nil, nil
+   batchMutex.Unlock()
+}
+
+// starts a server which, once the test and its deferred calls finish, waits for its
+// handlers to return; hijacked websockets outlive server.Close(), and would otherwise
+// read settings the next test changes
+func testServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+   var active int32
+
+   server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      atomic.AddInt32(&active, 1)
+      defer atomic.AddInt32(&active, -1)
+
+      handler(w, r)
+   }))
+
+   t.Cleanup(func() {
+      idle := func() bool {
+         return atomic.LoadInt32(&active) == 0 && len(clients()) == 0
+      }
+
+      // end any connection the test left open
+      if !eventually(idle) {
+         for _, c := range clients() {
+            c.socket.Close()
+         }
+
+         if !eventually(idle) {
+            t.Errorf("%d handlers still running", atomic.LoadInt32(&active))
+         }
+      }
+
+      server.Close()
+   })
+
+   return server
+}
+
+// starts a server with a fake sensor and returns a signed-on client
+func dial(t *testing.T) (*websocket.Conn, func()) {
+   return dialToken(t, *token)
+}
+
+func dialToken(t *testing.T, tok string) (*websocket.Conn, func()) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+
+   server := testServer(t, monitor)
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   client, _, err := websocket.DefaultDialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   err = client.WriteMessage(websocket.TextMessage, []byte(tok))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var signon SignonMessage
+   err = client.ReadJSON(&signon)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var change ChangeMessage
+   err = client.ReadJSON(&change)
+   if err != nil || change.Op != "enabled" {
+      t.Fatalf("got %+v, %v; want enabled message", change, err)
+   }
+
+   // registered just after the change message is sent
+   for i := 0; len(clients()) == 0; i++ {
+      if i == 100 {
+         t.Fatal("connection not registered")
+      }
+      time.Sleep(10 * time.Millisecond)
+   }
+
+   // the server is closed once its handlers return, when the test ends
+   return client, func() {
+      client.Close()
+   }
+}
+
+func expectError(t *testing.T, client *websocket.Conn, code string) {
+   var msg ErrorMessage
+   err := client.ReadJSON(&msg)
+
+   if err != nil || msg.Op != "error" || msg.Code != code {
+      t.Fatalf("got %+v, %v; want error %s", msg, err, code)
+   }
+}
+
+func TestToggleBadState(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "maybe"})
+   expectError(t, client, errInvalidValue)
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "no such event", "State": "on"})
+   expectError(t, client, errUnknownEvent)
+
+   // connection survives and valid updates still apply
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "on"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil || len(change.Enabled["fake"]) != 1 {
+      t.Fatalf("got %+v, %v", change, err)
+   }
+}
+
+func TestToggleWhileSampling(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   stop := make(chan struct{})
+   done := make(chan struct{})
+
+   go func() {
+      defer close(done)
+
+      for {
+         select {
+         case <-stop:
+            return
+         default:
+         }
+
+         samples, _ := sampleAll(0)
+         for _, val := range samples[1:] {
+            if val < 0 {
+               t.Error("sampled before baseline was initialised")
+               return
+            }
+         }
+      }
+   }()
+
+   for i := 0; i < 1000; i++ {
+      state("fake event 1", i%2 == 0)
+   }
+
+   close(stop)
+   <-done
+}
+
+func TestTogglePattern(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "pattern", "Pattern": "*EVENT [12]", "State": "on"})
+
+   var reply PatternMessage
+   err := client.ReadJSON(&reply)
+   if err != nil || reply.Matched != 2 {
+      t.Fatalf("got %+v, %v; want 2 matched", reply, err)
+   }
+
+   var change ChangeMessage
+   err = client.ReadJSON(&change)
+   if err != nil || len(change.Enabled["fake"]) != 2 {
+      t.Fatalf("got %+v, %v", change, err)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "pattern", "Pattern": "*nothing*", "State": "on"})
+   expectError(t, client, errUnknownEvent)
+}
+
+func TestSplitFrames(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   saved := *maxFrameBytes
+   *maxFrameBytes = 256
+   defer func() {
+      *maxFrameBytes = saved
+   }()
+
+   epochs := testEpochs(100)
+   broadcastData(epochs, nil)
+
+   var data string
+   for {
+      var msg ContinuedMessage
+      err := client.ReadJSON(&msg)
+      if err != nil || msg.Op != "continued" {
+         t.Fatalf("got %+v, %v", msg, err)
+      }
+
+      data += msg.Data
+      if !msg.More {
+         break
+      }
+   }
+
+   var got [][]int64
+   err := json.Unmarshal([]byte(data), &got)
+   if err != nil || !reflect.DeepEqual(got, epochs) {
+      t.Fatalf("reassembled %v, %v", got, err)
+   }
+}
+
+func TestResourcesDir(t *testing.T) {
+   root := t.TempDir()
+   inside := filepath.Join(root, "web")
+   outside := t.TempDir()
+
+   err := os.Mkdir(inside, 0755)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   file := filepath.Join(root, "file")
+   err = os.WriteFile(file, nil, 0644)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // reaches outside the root via a symlink
+   link := filepath.Join(root, "link")
+   err = os.Symlink(outside, link)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   _, err = resourcesDir(inside, root)
+   if err != nil {
+      t.Errorf("%s: %v", inside, err)
+   }
+
+   for _, dir := range []string{outside, file, link, filepath.Join(root, "missing"), inside + "/../.."} {
+      _, err = resourcesDir(dir, root)
+      if err == nil {
+         t.Errorf("%s: accepted", dir)
+      }
+   }
+
+   _, err = resourcesDir(filepath.Join(root, "missing"), "")
+   if err == nil || !strings.Contains(err.Error(), "missing: not found") {
+      t.Errorf("missing directory reported as %v", err)
+   }
+}
+
+func TestDisplayURL(t *testing.T) {
+   for addr, want := range map[string]string{
+      ":80": "http://localhost/",
+      "0.0.0.0:8080": "http://localhost:8080/",
+      "[::]:8080": "http://localhost:8080/",
+      "[fe80::1]:80": "http://[fe80::1]/",
+      "[2001:db8::2]:8080": "http://[2001:db8::2]:8080/",
+      "server.example:8080": "http://server.example:8080/",
+   } {
+      got := displayURL(addr)
+      if got != want {
+         t.Errorf("%s: got %s, want %s", addr, got, want)
+      }
+   }
+}
+
+func TestAveragingRejected(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   present[0].(*fakeSensor).reject = true
+   saved := *discrete
+   *discrete = false
+   defer func() {
+      *discrete = saved
+   }()
+
+   client.WriteJSON(map[string]string{"Op": "averaging", "Value": "false"})
+   expectError(t, client, errSensor)
+
+   if *discrete {
+      t.Fatal("averaging mode changed despite the sensor refusing it")
+   }
+}
+
+func TestSpectator(t *testing.T) {
+   saved := *spectatorToken
+   *spectatorToken = "spectator"
+   defer func() {
+      *spectatorToken = saved
+   }()
+
+   client, done := dialToken(t, "spectator")
+   defer done()
+
+   for _, op := range []string{"update", "averaging", "interval", "sample"} {
+      client.WriteJSON(map[string]string{"Op": op, "Event": "fake event 0", "State": "on", "Value": "100"})
+      expectError(t, client, errForbidden)
+   }
+
+   // per-connection ops are still allowed
+   client.WriteJSON(map[string]string{"Op": "digits", "Value": "3"})
+   client.WriteJSON(map[string]string{"Op": "pattern", "Pattern": "*", "State": "on"})
+   expectError(t, client, errForbidden)
+}
+
+func TestShutdown(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   result := make(chan error)
+   go func() {
+      ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+      defer cancel()
+      result <- Shutdown(ctx)
+   }()
+
+   // reading replies to the close frame
+   _, _, err := client.ReadMessage()
+   cerr, ok := err.(*websocket.CloseError)
+   if !ok || cerr.Code != websocket.CloseGoingAway || !strings.Contains(cerr.Text, "shutting down") {
+      t.Fatalf("got %v, want going away close", err)
+   }
+
+   err = <-result
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(clients()) != 0 {
+      t.Fatalf("%d clients remain", len(clients()))
+   }
+}
+
+func TestSampleNow(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "on"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   other, f := fakeConnection()
+   defer remove(other.socket)
+
+   client.WriteJSON(map[string]string{"Op": "sample"})
+
+   var data [][]int64
+   err = client.ReadJSON(&data)
+   if err != nil || len(data) != 1 || len(data[0]) != 2 {
+      t.Fatalf("got %v, %v; want one sample", data, err)
+   }
+
+   // others get it with their next batch, rather than now
+   if len(f.sent()) != 0 || batched() != 1 {
+      t.Fatalf("other client got %v, %d batched", f.sent(), batched())
+   }
+
+   // too soon after the last
+   client.WriteJSON(map[string]string{"Op": "sample"})
+   expectError(t, client, errLimit)
+}
+
+func TestResetOp(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "on"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   other, f := fakeConnection()
+   defer remove(other.socket)
+
+   sensor := present[0].(*fakeSensor)
+   sensor.Lock()
+   before := sensor.count
+   sensor.Unlock()
+
+   client.WriteJSON(map[string]string{"Op": "reset"})
+
+   var label LabelMessage
+   err = client.ReadJSON(&label)
+   if err != nil || label.Op != "label" || label.Label != "reset" {
+      t.Fatalf("got %+v, %v; want reset label", label, err)
+   }
+
+   // a sample was discarded to re-baseline
+   sensor.Lock()
+   after := sensor.count
+   sensor.Unlock()
+   if after == before {
+      t.Fatal("sensor not sampled")
+   }
+
+   // and other clients see the label too
+   sent := f.sent()
+   if len(sent) != 1 || !strings.Contains(sent[0], `"reset"`) {
+      t.Fatalf("other client got %v", sent)
+   }
+}
+
+func TestIntervalMinimum(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "interval", "Value": fmt.Sprint(minInterval - 1)})
+   expectError(t, client, errLimit)
+}
+
+func TestSubprotocol(t *testing.T) {
+   server := testServer(t, monitor)
+   defer server.Close()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   dialer := websocket.Dialer{Subprotocols: []string{"other", subprotocol}}
+   client, _, err := dialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if client.Subprotocol() != subprotocol {
+      t.Errorf("negotiated '%s', want %s", client.Subprotocol(), subprotocol)
+   }
+   client.Close()
+
+   dialer.Subprotocols = []string{"numascope.v0"}
+   client, _, err = dialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   _, _, err = client.ReadMessage()
+   cerr, ok := err.(*websocket.CloseError)
+   if !ok || cerr.Code != websocket.CloseProtocolError {
+      t.Fatalf("got %v, want protocol error close", err)
+   }
+}
+
+func TestAuthFailures(t *testing.T) {
+   server := testServer(t, monitor)
+   defer server.Close()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   before, _ := authFailureCounts()
+
+   client, _, err := websocket.DefaultDialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   client.WriteMessage(websocket.TextMessage, []byte("wrong"))
+
+   _, _, err = client.ReadMessage()
+   if _, ok := err.(*websocket.CloseError); !ok {
+      t.Fatalf("got %v, want close", err)
+   }
+
+   total, byIP := authFailureCounts()
+   if total != before+1 || byIP["127.0.0.1"] == 0 {
+      t.Fatalf("got %d failures, %v by IP", total, byIP)
+   }
+}
+
+func TestHeaderAuth(t *testing.T) {
+   *handshakeAuth = "either"
+   defer func() { *handshakeAuth = "message" }()
+
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   server := testServer(t, monitor)
+   defer server.Close()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   _, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer wrong"}})
+   if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+      t.Fatalf("got %v, want 401", err)
+   }
+
+   // no handshake message is sent
+   client, _, err := websocket.DefaultDialer.Dial(url+"?flags=verbose", http.Header{"Authorization": {"Bearer " + *token}})
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   var signon SignonMessage
+   err = client.ReadJSON(&signon)
+   if err != nil || !signon.Verbose {
+      t.Fatalf("got %+v, %v", signon, err)
+   }
+
+   *handshakeAuth = "header"
+   _, resp, err = websocket.DefaultDialer.Dial(url, nil)
+   if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+      t.Fatalf("got %v without header, want 401", err)
+   }
+}
+
+func TestCapabilitiesEndpoint(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+
+   w := httptest.NewRecorder()
+   capabilitiesEndpoint(w, httptest.NewRequest("GET", "/capabilities", nil))
+   if w.Code != http.StatusNotFound {
+      t.Fatalf("got %d while disabled", w.Code)
+   }
+
+   *publicCapabilities = true
+   defer func() { *publicCapabilities = false }()
+
+   w = httptest.NewRecorder()
+   capabilitiesEndpoint(w, httptest.NewRequest("GET", "/capabilities", nil))
+
+   var msg CapabilitiesMessage
+   err := json.Unmarshal(w.Body.Bytes(), &msg)
+   if err != nil || msg.Version != protocolVersion || len(msg.Capabilities) == 0 || len(msg.Tree["fake"]) != 3 {
+      t.Fatalf("got %s, %v", w.Body, err)
+   }
+}
+
+func TestGlobMatch(t *testing.T) {
+   cases := []struct {
+      pattern, s string
+      want       bool
+   }{
+      {"https://dash.internal", "https://dash.internal", true},
+      {"https://dash.internal", "https://dash.internal.evil", false},
+      {"https://*.internal", "https://dash.internal", true},
+      {"*Firefox/*", "Mozilla/5.0 (X11; Linux) Gecko/20100101 Firefox/118.0", true},
+      {"*Firefox/*", "curl/8.0", false},
+      {"a*b*b", "abb", true},
+      {"ab*b", "ab", false},
+      {"*", "", true},
+   }
+
+   for _, c := range cases {
+      if got := globMatch(c.pattern, c.s); got != c.want {
+         t.Errorf("globMatch(%q, %q) = %v", c.pattern, c.s, got)
+      }
+   }
+}
+
+func TestDisallowed(t *testing.T) {
+   saved := *allowOrigins
+   *allowOrigins = "https://dash.internal, https://*.ops.internal"
+   defer func() {
+      *allowOrigins = saved
+   }()
+
+   r := httptest.NewRequest("GET", "/monitor", nil)
+   r.Header.Set("Origin", "https://grafana.ops.internal")
+   if reason := disallowed(r); reason != "" {
+      t.Fatalf("refused allowed origin: %s", reason)
+   }
+
+   before := rejectionCounts()["origin"]
+
+   r.Header.Set("Origin", "https://evil.example")
+   if reason := disallowed(r); reason != "origin not allowed" {
+      t.Fatalf("got '%s'", reason)
+   }
+
+   if rejectionCounts()["origin"] != before+1 {
+      t.Fatal("rejection not counted")
+   }
+}
+
+func TestChunkedSignon(t *testing.T) {
+   saved := *signonChunk
+   *signonChunk = 2
+   defer func() {
+      *signonChunk = saved
+   }()
+
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   server := testServer(t, monitor)
+   defer server.Close()
+
+   client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   client.WriteMessage(websocket.TextMessage, []byte(*token+" chunked"))
+
+   var signon SignonMessage
+   err = client.ReadJSON(&signon)
+   if err != nil || !signon.Chunked || signon.Tree != nil || len(signon.Order) != 1 {
+      t.Fatalf("got %+v, %v", signon, err)
+   }
+
+   var events []string
+   for _, offset := range []int{0, 2} {
+      var part SignonPart
+      err = client.ReadJSON(&part)
+      if err != nil || part.Op != "signon-part" || part.Offset != offset || part.Sources != 2 {
+         t.Fatalf("got %+v, %v", part, err)
+      }
+      events = append(events, part.Events...)
+   }
+
+   if len(events) != 3 || events[2] != "fake event 2" {
+      t.Fatalf("got events %v", events)
+   }
+
+   var complete map[string]interface{}
+   err = client.ReadJSON(&complete)
+   if err != nil || complete["Op"] != "signon-complete" {
+      t.Fatalf("got %v, %v", complete, err)
+   }
+}
+
+// returns a value too few
+type shortSensor struct {
+   *fakeSensor
+}
+
+func (d shortSensor) Sample() []int64 {
+   samples := d.fakeSensor.Sample()
+   return samples[:len(samples)-1]
+}
+
+func TestCheckWidths(t *testing.T) {
+   defer func() {
+      *discrete = false
+   }()
+
+   fake := newFakeSensor()
+   fake.events[1].enabled = true
+   present = []Sensor{fake}
+
+   for _, mode := range []bool{false, true} {
+      *discrete = mode
+
+      err := fake.Enable(mode)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      err = checkWidths()
+      if err != nil {
+         t.Fatalf("discrete %v: %v", mode, err)
+      }
+   }
+
+   present = []Sensor{shortSensor{fake}}
+
+   err := checkWidths()
+   if err == nil || !strings.Contains(err.Error(), "fake returned 1 values, expected 2") {
+      t.Fatalf("got %v", err)
+   }
+}
+
+func TestFreeze(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "on"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "sample"})
+   _, sent, err := client.ReadMessage()
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "freeze"})
+   client.WriteJSON(map[string]string{"Op": "sample"})
+   expectError(t, client, errInvalidValue)
+
+   for i := 0; i < 2; i++ {
+      client.WriteJSON(map[string]string{"Op": "frame"})
+      _, held, err := client.ReadMessage()
+      if err != nil || string(held) != string(sent) {
+         t.Fatalf("got %s, %v; want %s", held, err, sent)
+      }
+
+      // not sent while frozen
+      broadcastData([][]int64{{now(), 1}}, nil)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "unfreeze"})
+   client.WriteJSON(map[string]string{"Op": "frame"})
+   expectError(t, client, errInvalidValue)
+}
+
+func TestMonotonicClock(t *testing.T) {
+   *clock = "monotonic"
+   defer func() { *clock = "wall" }()
+
+   first := now()
+   second := now()
+   if first < 0 || second < first {
+      t.Fatalf("timestamps %d then %d", first, second)
+   }
+
+   wall := time.Now().UnixNano() / timeUnit()
+   if diff := origin() + second - wall; diff > 1e6 || diff < -1e6 {
+      t.Fatalf("origin %d + %d is %d from wall time", origin(), second, diff)
+   }
+}
+
+func TestViewers(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   server := testServer(t, monitor)
+   defer server.Close()
+
+   join := func(want int) *websocket.Conn {
+      client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      client.WriteMessage(websocket.TextMessage, []byte(*token))
+
+      var signon SignonMessage
+      err = client.ReadJSON(&signon)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      var change ChangeMessage
+      err = client.ReadJSON(&change)
+      if err != nil || change.Clients != want {
+         t.Fatalf("got %+v, %v; want %d clients", change, err, want)
+      }
+
+      return client
+   }
+
+   expect := func(client *websocket.Conn, want int) {
+      var change ChangeMessage
+      err := client.ReadJSON(&change)
+      if err != nil || change.Clients != want {
+         t.Fatalf("got %+v, %v; want %d clients", change, err, want)
+      }
+   }
+
+   first := join(1)
+   defer first.Close()
+
+   if !eventually(func() bool { return len(clients()) == 1 }) {
+      t.Fatal("first client not registered")
+   }
+
+   second := join(2)
+   expect(first, 2)
+
+   second.Close()
+   expect(first, 1)
+}
+
+func TestNoCoalesce(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   savedMode := *coalesceMode
+   *coalesceMode = "count"
+   defer func() {
+      *coalesceMode = savedMode
+      *noCoalesce = false
+   }()
+
+   client.WriteJSON(map[string]string{"Op": "update", "Event": "fake event 0", "State": "on"})
+   client.WriteJSON(map[string]string{"Op": "interval", "Value": "10"})
+
+   var change ChangeMessage
+   for i := 0; i < 2; i++ {
+      err := client.ReadJSON(&change)
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+
+   // batched until -coalesce-count samples are taken
+   if flushDue(1, 0) {
+      t.Fatal("single sample sent in count mode")
+   }
+
+   *noCoalesce = true
+
+   for i := 0; i < 3; i++ {
+      // samples closer than the client's interval are skipped
+      time.Sleep(10 * time.Millisecond)
+
+      coalesce(sampleAll(now()))
+      if n := batched(); n != 0 {
+         t.Fatalf("%d samples still batched", n)
+      }
+
+      var data [][]int64
+      err := client.ReadJSON(&data)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      if len(data) != 1 {
+         t.Fatalf("got %d samples in message %d; want 1", len(data), i)
+      }
+   }
+}
+
+func TestMalformedRequest(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   for _, bad := range []string{"{\"Op\":", "[1,2]", "{\"Op\":3}"} {
+      client.WriteMessage(websocket.TextMessage, []byte(bad))
+      expectError(t, client, errMalformed)
+   }
+
+   // still connected
+   client.WriteJSON(map[string]string{"Op": "nonsense"})
+   expectError(t, client, errUnknownOp)
+}
+
+func TestSensorMetrics(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   absent = []string{"NumaConnect2"}
+   defer func() {
+      absent = nil
+   }()
+
+   w := httptest.NewRecorder()
+   metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+   for _, want := range []string{
+      `numascope_sensor_present{sensor="fake"} 1`,
+      `numascope_sensor_present{sensor="NumaConnect2"} 0`,
+      `numascope_sensor_sources{sensor="fake"} 2`,
+      `numascope_sensor_events{sensor="fake"} 3`,
+   } {
+      if !strings.Contains(w.Body.String(), want+"\n") {
+         t.Errorf("missing %s", want)
+      }
+   }
+}
+
+func TestOpMetrics(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   before := opCosts()
+
+   client.WriteJSON(map[string]string{"Op": "no-such-op"})
+   expectError(t, client, errUnknownOp)
+   client.WriteJSON(map[string]string{"Op": "interval", "Value": "500"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "frame"})
+   expectError(t, client, errInvalidValue)
+
+   after := opCosts()
+   if after["unknown"].Requests != before["unknown"].Requests+1 || after["interval"].Requests != before["interval"].Requests+1 {
+      t.Fatalf("got %+v", after)
+   }
+
+   if _, ok := after["no-such-op"]; ok {
+      t.Fatal("unknown op named in metrics")
+   }
+}
+
+// fails to initialise a number of times, as if its driver were loading
+type flakySensor struct {
+   *fakeSensor
+   failures int
+}
+
+func (d *flakySensor) Probe() error {
+   if d.failures > 0 {
+      d.failures--
+      return errors.New("device busy")
+   }
+
+   return nil
+}
+
+type absentSensor struct {
+   *fakeSensor
+   probes int
+}
+
+func (d *absentSensor) Probe() error {
+   d.probes++
+   return errAbsent
+}
+
+func TestDetectRetries(t *testing.T) {
+   absent = nil
+   defer func() {
+      absent = nil
+   }()
+
+   flaky := &flakySensor{newFakeSensor(), 2}
+   missing := &absentSensor{fakeSensor: newFakeSensor()}
+
+   found := detect([]Sensor{flaky, missing}, 3, time.Millisecond)
+   if len(found) != 1 || found[0] != Sensor(flaky) {
+      t.Fatalf("found %v", found)
+   }
+
+   // absent hardware isn't worth retrying
+   if missing.probes != 1 || len(absent) != 1 {
+      t.Fatalf("probed %d times, absent %v", missing.probes, absent)
+   }
+
+   flaky.failures = 5
+   absent = nil
+   if found := detect([]Sensor{flaky}, 2, time.Millisecond); len(found) != 0 || len(absent) != 1 {
+      t.Fatalf("found %v after retries exhausted", found)
+   }
+}
+
+func TestOversizedRequest(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   huge := `{"Op":"update","Event":"` + strings.Repeat("x", int(*maxRequest)) + `"}`
+   client.WriteMessage(websocket.TextMessage, []byte(huge))
+
+   _, _, err := client.ReadMessage()
+   cerr, ok := err.(*websocket.CloseError)
+   if !ok || cerr.Code != websocket.CloseMessageTooBig {
+      t.Fatalf("got %v, want message too big close", err)
+   }
+
+   if !eventually(func() bool { return len(clients()) == 0 }) {
+      t.Fatal("connection not removed")
+   }
+}
+
+func TestPauseSampling(t *testing.T) {
+   client, done := dial(t)
+   defer done()
+
+   client.WriteJSON(map[string]string{"Op": "pause-sampling"})
+
+   var change ChangeMessage
+   err := client.ReadJSON(&change)
+   if err != nil || !change.Paused {
+      t.Fatalf("got %+v, %v; want paused", change, err)
+   }
+
+   client.WriteJSON(map[string]string{"Op": "sample"})
+   expectError(t, client, errInvalidValue)
+
+   client.WriteJSON(map[string]string{"Op": "pause-sampling"})
+   expectError(t, client, errInvalidValue)
+
+   client.WriteJSON(map[string]string{"Op": "resume-sampling"})
+
+   var label LabelMessage
+   err = client.ReadJSON(&label)
+   if err != nil || label.Label != "reset" {
+      t.Fatalf("got %+v, %v; want reset label", label, err)
+   }
+
+   err = client.ReadJSON(&change)
+   if err != nil || change.Paused {
+      t.Fatalf("got %+v, %v; want resumed", change, err)
+   }
+}
+
+func TestCapabilities(t *testing.T) {
+   saved := *summaryWindow
+   defer func() { *summaryWindow = saved }()
+
+   has := func(name string) bool {
+      for _, c := range capabilities() {
+         if c == name {
+            return true
+         }
+      }
+      return false
+   }
+
+   *summaryWindow = 0
+   if !has("order") || has("summary") {
+      t.Fatalf("got %v without summaries", capabilities())
+   }
+
+   *summaryWindow = time.Minute
+   if !has("summary") {
+      t.Fatalf("got %v with summaries", capabilities())
+   }
+}
+
+func TestReserveSlots(t *testing.T) {
+   resetConnections()
+   saved := *maxConnections
+   *maxConnections = 2
+   defer func() {
+      *maxConnections = saved
+   }()
+
+   a, b, c := &Connection{}, &Connection{}, &Connection{}
+   if !a.reserve() || !b.reserve() {
+      t.Fatal("slot refused below the limit")
+   }
+
+   // neither has registered yet, but both count
+   if c.reserve() {
+      t.Fatal("slot given beyond the limit")
+   }
+
+   a.unreserve()
+   if !c.reserve() {
+      t.Fatal("freed slot refused")
+   }
+
+   b.unreserve()
+   c.unreserve()
+   if reserved != 0 {
+      t.Fatalf("%d slots still reserved", reserved)
+   }
+}
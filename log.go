@@ -0,0 +1,189 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "flag"
+   "fmt"
+   "io"
+   "os"
+   "sort"
+   "strings"
+   "sync"
+   "time"
+)
+
+// subsystems which can print debugging output
+var subsystems = []string{"ws", "sampling", "labels", "broadcast"}
+
+// set of subsystems to debug; behaves as a boolean flag when given without a value
+type debugSet map[string]bool
+
+func newDebugFlag(name, usage string) *debugSet {
+   d := &debugSet{}
+   flag.Var(d, name, usage)
+   return d
+}
+
+func (d *debugSet) String() string {
+   if d == nil {
+      return ""
+   }
+
+   var names []string
+   for name := range *d {
+      names = append(names, name)
+   }
+   sort.Strings(names)
+
+   return strings.Join(names, ",")
+}
+
+func (d *debugSet) Set(val string) error {
+   set := debugSet{}
+
+   switch val {
+   case "true", "all":
+      for _, name := range subsystems {
+         set[name] = true
+      }
+   case "false", "":
+   default:
+      for _, name := range strings.Split(val, ",") {
+         known := false
+
+         for _, sub := range subsystems {
+            if name == sub {
+               known = true
+            }
+         }
+
+         if !known {
+            return fmt.Errorf("unknown subsystem '%s'", name)
+         }
+
+         set[name] = true
+      }
+   }
+
+   *d = set
+   return nil
+}
+
+func (d *debugSet) IsBoolFlag() bool {
+   return true
+}
+
+// fields attached to a log message in JSON format
+type logFields map[string]interface{}
+
+// keeps JSON lines whole when logged concurrently
+var logMutex sync.Mutex
+
+// writes a message as text, or as a JSON object with the level and fields if -log-format is json
+func logTo(w io.Writer, level string, fields logFields, msg string) {
+   if *logFormat != "json" {
+      fmt.Fprintln(w, msg)
+      return
+   }
+
+   obj := logFields{}
+   for key, val := range fields {
+      // eg durations are clearer as strings
+      if s, ok := val.(fmt.Stringer); ok {
+         val = s.String()
+      }
+      obj[key] = val
+   }
+
+   obj["time"] = time.Now().Format(time.RFC3339Nano)
+   obj["level"] = level
+   obj["msg"] = msg
+
+   b, err := json.Marshal(obj)
+   if err != nil {
+      b, _ = json.Marshal(logFields{"level": level, "msg": msg})
+   }
+
+   logMutex.Lock()
+   w.Write(append(b, '\n'))
+   logMutex.Unlock()
+}
+
+// logs to stdout at level info, warn or error
+func logf(level string, fields logFields, format string, args ...interface{}) {
+   logTo(os.Stdout, level, fields, fmt.Sprintf(format, args...))
+}
+
+// whether debugging output is enabled for the subsystem
+func debugging(subsystem string) bool {
+   settingsMutex.RLock()
+   defer settingsMutex.RUnlock()
+
+   return (*debug)[subsystem]
+}
+
+// prints debugging output to stderr if the subsystem is enabled
+func debugf(subsystem, format string, args ...interface{}) {
+   if debugging(subsystem) {
+      msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+      logTo(os.Stderr, "debug", logFields{"subsystem": subsystem}, msg)
+   }
+}
+
+func debugln(subsystem string, args ...interface{}) {
+   if debugging(subsystem) {
+      msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+      logTo(os.Stderr, "debug", logFields{"subsystem": subsystem}, msg)
+   }
+}
+
+// attributes a message to a connection, in text as a prefix and in JSON as fields
+func (c *Connection) fields(fields logFields, msg string) (logFields, string) {
+   out := logFields{"client": c.addr, "conn": c.id}
+   for key, val := range fields {
+      out[key] = val
+   }
+
+   if *logFormat != "json" {
+      msg = "[" + c.id + "] " + msg
+   }
+
+   return out, msg
+}
+
+func (c *Connection) logf(level string, fields logFields, format string, args ...interface{}) {
+   fields, msg := c.fields(fields, fmt.Sprintf(format, args...))
+   logTo(os.Stdout, level, fields, msg)
+}
+
+func (c *Connection) debugf(subsystem, format string, args ...interface{}) {
+   if debugging(subsystem) {
+      fields, msg := c.fields(logFields{"subsystem": subsystem}, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+      logTo(os.Stderr, "debug", fields, msg)
+   }
+}
+
+func (c *Connection) debugln(subsystem string, args ...interface{}) {
+   if debugging(subsystem) {
+      fields, msg := c.fields(logFields{"subsystem": subsystem}, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+      logTo(os.Stderr, "debug", fields, msg)
+   }
+}
@@ -0,0 +1,68 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "bytes"
+   "encoding/json"
+   "testing"
+   "time"
+)
+
+func TestLogJSON(t *testing.T) {
+   saved := *logFormat
+   *logFormat = "json"
+   defer func() {
+      *logFormat = saved
+   }()
+
+   var buf bytes.Buffer
+   logTo(&buf, "warn", logFields{"sensor": "fake", "elapsed": 3 * time.Millisecond}, "sampling fake took 3ms")
+
+   var got map[string]interface{}
+   err := json.Unmarshal(buf.Bytes(), &got)
+   if err != nil {
+      t.Fatalf("%q: %v", buf.String(), err)
+   }
+
+   if got["level"] != "warn" || got["msg"] != "sampling fake took 3ms" || got["sensor"] != "fake" || got["elapsed"] != "3ms" || got["time"] == nil {
+      t.Fatalf("got %v", got)
+   }
+}
+
+func TestConnectionFields(t *testing.T) {
+   c := Connection{addr: "10.0.0.1:5000", id: "0a1b2c3d"}
+
+   fields, msg := c.fields(logFields{"code": "limit"}, "rejected")
+   if msg != "[0a1b2c3d] rejected" || fields["conn"] != "0a1b2c3d" || fields["client"] != "10.0.0.1:5000" || fields["code"] != "limit" {
+      t.Fatalf("got %v, %q", fields, msg)
+   }
+
+   saved := *logFormat
+   *logFormat = "json"
+   defer func() {
+      *logFormat = saved
+   }()
+
+   // the ID is already a field
+   _, msg = c.fields(nil, "rejected")
+   if msg != "rejected" {
+      t.Fatalf("got %q", msg)
+   }
+}
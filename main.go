@@ -21,8 +21,12 @@ import (
    "flag"
    "fmt"
    "os"
+   "os/signal"
+   "sort"
    "strconv"
    "strings"
+   "syscall"
+   "time"
 
    "golang.org/x/sys/unix"
 )
@@ -30,27 +34,85 @@ import (
 const (
    fifoPath = "/run/numascope-ctl"
    pidPath = "/run/numascope.pid"
-   coalescing = 600e3
+   minInterval = 10 // ms; shorter intervals cost more in sampling than they show
 )
 
 var (
 // TODO enable advanced when there is useful discrimitation
 //   advanced   = flag.Bool("advanced", false, "list all events")
-   listenAddr = flag.String("listenAddr", "0.0.0.0:80", "web service listen address and port")
-   debug      = flag.Bool("debug", false, "print debugging output")
-   events     = flag.String("events", "pgfault,pgalloc_normal,pgfree,numa_local,n2VicBlkXSent,n2RdBlkXSent,n2RdBlkModSent,n2ChangeToDirtySent,n2BcastProbeCmdSent,n2RdRespSent,n2ProbeRespSent", "comma-separated list of events")
+   listenAddr = flag.String("listenAddr", "0.0.0.0:80", "web service listen address and port, unix:<path> for a local socket, or empty to only push to -collector")
+   collector  = flag.String("collector", "", "also push signon and data to the websocket collector at this URL, eg ws://central/monitor")
+   collectorToken = flag.String("collector-token", "", "token presented to -collector, if not -token")
+   nodeName   = flag.String("node-name", "", "name identifying this host to clients and collectors, default the hostname")
+   logFormat  = flag.String("log-format", "text", "log as human-readable text or as JSON objects, one per line")
+   debug      = newDebugFlag("debug", "print debugging output to stderr, optionally only for a comma-separated list of ws, sampling, labels, broadcast")
+   events     = flag.String("events", "pgfault,pgalloc_normal,pgfree,numa_local,n2VicBlkXSent,n2RdBlkXSent,n2RdBlkModSent,n2ChangeToDirtySent,n2BcastProbeCmdSent,n2RdRespSent,n2ProbeRespSent", "comma-separated list of events to enable at startup, or all")
+   enableEvents = flag.String("enable", "", "comma-separated list of further events to enable at startup, or all, eg for recording without a browser")
    list       = flag.Bool("list", false, "list events available on this host")
    discrete   = flag.Bool("discrete", false, "report events per unit, rather than average")
    recordFile = flag.String("filename", "output.json", "filename to record to")
-   interval   = flag.Int("interval", 256, "sample interval in ms")
+   traceOut   = flag.String("trace-out", "", "when recording, also write samples as counters and labels as instant events to this Chrome trace file, eg for Perfetto")
+   interval   = flag.Int("interval", 256, "sample interval in ms, at least 10")
    overwrite  = flag.Bool("overwrite", false, "overwrite existing file")
-
-   // highest priority first
+   rotateSize = flag.Int64("record-rotate-size", 0, "start a new recording file after this many bytes, 0 to disable")
+   rotateInterval = flag.Duration("record-rotate-interval", 0, "start a new recording file after this duration, 0 to disable")
+   recordGaps = flag.String("record-gaps", "raw", "when samples are late, record them as they are (raw), add a [\"gap\",from,to] entry (mark) or interpolate the missing samples (interpolate)")
+   rotateGzip = flag.Bool("record-rotate-gzip", false, "gzip recording files once rotated")
+   labelChannels = flag.String("label-channels", "", "comma-separated name=path FIFOs for further named label streams, eg anomaly=/run/numascope-anomaly")
+   noLabels   = flag.Bool("no-labels", false, "don't read labels and commands from "+fifoPath)
+   labelDedup = flag.Duration("label-dedup", 0, "drop a label repeating the previous one on its channel within this time, 0 to keep repeats")
+   maxConnections = flag.Int("max-connections", 0, "maximum web clients, 0 for unlimited")
+   tcpKeepalive = flag.Duration("tcp-keepalive", 15*time.Second, "interval between TCP keepalive probes to web clients, negative to disable")
+   readHeaderTimeout = flag.Duration("http-read-header-timeout", 10*time.Second, "drop HTTP clients not sending request headers within this time, 0 to wait indefinitely")
+   readTimeout = flag.Duration("http-read-timeout", 30*time.Second, "drop HTTP clients not sending a whole request within this time, up to the websocket upgrade, 0 to wait indefinitely")
+   idleTimeout = flag.Duration("http-idle-timeout", 2*time.Minute, "close idle keep-alive HTTP connections after this time, 0 to use the read timeout")
+   maxLabel   = flag.Int("max-label", 256, "truncate labels to this many characters, 0 for no limit")
+   maxRequest = flag.Int64("max-request-bytes", 16384, "close connections sending a handshake or request larger than this")
+   sessionTimeout = flag.Duration("session-timeout", 10*time.Minute, "how long a disconnected browser can resume its settings, 0 to disable")
+   signonTimeout = flag.Duration("signon-timeout", 10*time.Second, "close connections which don't accept the signon within this time, 0 to wait indefinitely")
+   maxWriteFailures = flag.Int("max-write-failures", 3, "disconnect a client after this many consecutive failed writes, 0 to never")
+   sensorAttempts = flag.Int("sensor-attempts", 1, "times to try initialising a sensor which fails other than by being absent, eg as its driver is loading, doubling the delay from 1s")
+   writeStall = flag.Duration("write-stall", 30*time.Second, "forcibly close a client whose write has blocked for this long, 0 to never")
+   heartbeatInterval = flag.Duration("heartbeat", 5*time.Second, "message idle clients this often, 0 to disable")
+   maxFrameBytes = flag.Int("max-frame-bytes", 0, "split data messages larger than this, 0 for unlimited")
+   historyLen = flag.Int("history", 0, "number of recent samples to keep for queries, 0 to disable")
+   summaryWindow = flag.Duration("summary-window", 0, "window of the rolling min/max/avg of each event, 0 to disable")
+   sampleBudget = flag.Float64("sample-budget", 0.5, "warn when sampling a sensor takes over this fraction of the interval, 0 to disable")
+   metricsListen = flag.String("metrics-listen", "", "serve /healthz and /metrics on this address instead of with the web interface")
+   metricsAuth = flag.Bool("metrics-auth", false, "require the token as an 'Authorization: Bearer' header for /healthz and /metrics")
+   pprofAddr  = flag.String("pprof", "", "serve Go profiling data on this address, eg 127.0.0.1:6060")
+   basePath   = flag.String("base-path", "", "serve everything under this URL path, eg /numascope behind a reverse proxy")
+   resources  = flag.String("resources", "", "directory of web interface files (default /usr/local/share/numascope or ./resources)")
+   resourcesRoot = flag.String("resources-root", "", "refuse to serve a resources directory outside this directory")
+   configFile = flag.String("config", "", "JSON file of settings; command-line flags take precedence")
+   dumpConfigFlag = flag.Bool("dump-config", false, "print the effective settings, sensor options and enabled events as a -config file, without tokens, and exit")
+   coalescing = flag.Int("coalescing", 600000, "time window in us to batch samples into one message")
+   coalesceMode = flag.String("coalesce-mode", "time", "when to send batched samples: time (after -coalescing), count (after -coalesce-count samples) or hybrid (whichever is first)")
+   coalesceCount = flag.Int("coalesce-count", 4, "samples to batch into one message in count and hybrid modes")
+   noCoalesce = flag.Bool("no-coalesce", false, "send each sample as soon as it is taken, as does -coalescing 0")
+   lazy       = flag.Bool("lazy", false, "sample only when a connected client's interval is due, never without clients")
+   token      = flag.String("token", "463ba1974b06", "token web clients must present")
+   allowOrigins = flag.String("allow-origins", "", "comma-separated Origin patterns websocket clients must match, * matching anything; default same-origin only")
+   allowAgents = flag.String("allow-user-agents", "", "comma-separated User-Agent patterns websocket clients must match, * matching anything")
+   signonChunk = flag.Int("signon-chunk", 512, "events per message when sending a larger sensor tree to clients accepting a chunked signon")
+   spectatorToken = flag.String("spectator-token", "", "token for read-only web clients which can't change events, interval or averaging")
+   maxColumns = flag.Int("max-columns", 4096, "maximum enabled event values per sample, 0 for unlimited")
+   compressMinBytes = flag.Int("compress-min-bytes", 512, "only compress messages of at least this size")
+   compressLevel = flag.Int("compress-level", 3, "websocket compression level from 1 (fastest) to 9 (smallest), 0 to disable")
+   nullColumns = flag.Bool("null-columns", false, "send a column for every event, null when disabled, so columns keep their positions")
+   safeIntegers = flag.Bool("safe-integers", false, "send values JavaScript can't represent exactly as strings")
+   timePrecision = flag.String("time-precision", "us", "timestamp precision, us or ns")
+   clock         = flag.String("clock", "wall", "timestamp source, wall or monotonic (relative to the signon's Origin)")
+   publicCapabilities = flag.Bool("public-capabilities", false, "serve /capabilities without the token, revealing the sensors and events supported")
+   handshakeAuth = flag.String("handshake-auth", "message", "where websocket clients present the token: message (first message), header ('Authorization: Bearer') or either, preferring the header")
+
+   // highest priority first, until sorted by name once probed
    present    = []Sensor{
       NewNumaconnect2(),
       NewKernel(),
    }
-   fifo       int
+   primary    Sensor // highest priority sensor present, used for recording
+   absent     []string // sensors whose probe failed
 )
 
 func dups() {
@@ -75,6 +137,135 @@ func dups() {
    }
 }
 
+// confirms what was found on this host
+func logSensors() {
+   for _, sensor := range present {
+      logf("info", logFields{"sensor": sensor.Name(), "sources": sensor.Sources(), "events": len(sensor.Events())},
+         "found %s with %d sources and %d events", sensor.Name(), sensor.Sources(), len(sensor.Events()))
+   }
+
+   for _, name := range absent {
+      logf("info", logFields{"sensor": name}, "%s not present", name)
+   }
+}
+
+func probe(sensor Sensor) error {
+   if p, ok := sensor.(prober); ok {
+      return p.Probe()
+   }
+
+   if !sensor.Present() {
+      return errAbsent
+   }
+
+   return nil
+}
+
+// returns the sensors which are present, adding the rest to absent; those failing
+// other than by being absent are retried with exponential backoff, eg for a driver
+// loading after startup
+func detect(sensors []Sensor, attempts int, delay time.Duration) []Sensor {
+   failed := make(map[Sensor]error, len(sensors))
+   pending := sensors
+
+   for attempt := 1; ; attempt++ {
+      var retry []Sensor
+
+      for _, sensor := range pending {
+         err := probe(sensor)
+         if err == nil {
+            delete(failed, sensor)
+            continue
+         }
+
+         failed[sensor] = err
+         if err != errAbsent {
+            retry = append(retry, sensor)
+         }
+      }
+
+      if len(retry) == 0 || attempt >= attempts {
+         break
+      }
+
+      for _, sensor := range retry {
+         logf("info", logFields{"sensor": sensor.Name(), "error": failed[sensor].Error(), "attempt": attempt},
+            "%s failed to initialise: %v; retrying in %v", sensor.Name(), failed[sensor], delay)
+      }
+
+      time.Sleep(delay)
+      delay *= 2
+      pending = retry
+   }
+
+   var found []Sensor
+
+   for _, sensor := range sensors {
+      err, ok := failed[sensor]
+      if !ok {
+         found = append(found, sensor)
+         continue
+      }
+
+      if err != errAbsent {
+         logf("warn", logFields{"sensor": sensor.Name(), "error": err.Error()},
+            "%s failed to initialise after %d attempts: %v", sensor.Name(), attempts, err)
+      }
+
+      absent = append(absent, sensor.Name())
+   }
+
+   return found
+}
+
+// detects, configures and enables events on the sensors, returning the number of
+// events enabled
+func setup(attempts int) int {
+   // remove any sensors where probe fails
+   present = detect(present, attempts, time.Second)
+
+   for i := range present {
+      present[i] = newMaskedSensor(present[i])
+   }
+
+   primary = present[0]
+
+   // clients map columns to events by this order
+   sort.SliceStable(present, func(i, j int) bool {
+      return present[i].Name() < present[j].Name()
+   })
+
+   for _, sensor := range present {
+      err := sensor.Configure(sensorConfig[sensor.Name()])
+      if err != nil {
+         fmt.Printf("%s: %v\n", sensor.Name(), err)
+         os.Exit(1)
+      }
+   }
+
+   elems := strings.Split(*events, ",")
+   if *enableEvents != "" {
+      elems = append(elems, strings.Split(*enableEvents, ",")...)
+   }
+
+   total := 0
+
+   for _, sensor := range present {
+      events := sensor.Events()
+
+      for _, elem := range elems {
+         for i := range events {
+            if events[i].mnemonic == elem || elem == "all" {
+               events[i].enabled = true
+               total++
+            }
+         }
+      }
+   }
+
+   return total
+}
+
 func pin() {
    var set unix.CPUSet
 
@@ -87,14 +278,31 @@ func pin() {
    unix.Setpriority(unix.PRIO_PROCESS, 0, -7)
 }
 
-func Activate() {
+// applies the enabled events and averaging mode to every sensor and discards a
+// sample to initialise their baselines; safe to call while live() is sampling
+func Activate() error {
+   sampling.Lock()
+   defer sampling.Unlock()
+
    for _, sensor := range present {
-      sensor.Enable(*discrete)
+      sensor.Lock()
+      err := sensor.Enable(*discrete)
+      sensor.Unlock()
+
+      if err != nil {
+         return fmt.Errorf("%s: %v", sensor.Name(), err)
+      }
+
+      sensor.Sample()
    }
+
+   return nil
 }
 
 func usage() {
    fmt.Println("Usage: numascope [option...] stat|live|record [command] [argument...]")
+   fmt.Println("       numascope [-token token] ping <host[:port][/base-path]>")
+   fmt.Println("       numascope verify <recording.json>..")
    flag.PrintDefaults()
 }
 
@@ -119,63 +327,229 @@ func exclusive() {
    validate(err)
 }
 
+func reloader() {
+   hup := make(chan os.Signal, 1)
+   signal.Notify(hup, syscall.SIGHUP)
+
+   for range hup {
+      if *configFile == "" {
+         logf("warn", nil, "no config file to reload")
+         continue
+      }
+
+      err := reloadConfig(*configFile)
+      if err != nil {
+         logf("error", logFields{"file": *configFile, "error": err.Error()}, "config reload failed: %v", err)
+         broadcastError(errConfig, "config reload failed: "+err.Error())
+         continue
+      }
+
+      logf("info", logFields{"file": *configFile}, "config reloaded")
+      changeAll()
+   }
+}
+
+// raises the sample interval to the minimum, so sampling can't monopolise a core;
+// settingsMutex must be held once other goroutines are running
+func clampInterval() {
+   if *interval >= minInterval {
+      return
+   }
+
+   logf("warn", logFields{"interval": *interval}, "interval %dms too short, using %dms", *interval, minInterval)
+   *interval = minInterval
+}
+
 func main() {
    pin()
 
    flag.Usage = usage
    flag.Parse()
 
-   if os.Geteuid() != 0 {
-      fmt.Println("please run with sudo/root")
+   if *configFile != "" {
+      err := loadConfig(*configFile)
+      if err != nil {
+         fmt.Println("config:", err)
+         os.Exit(1)
+      }
+   }
+
+   if *logFormat != "text" && *logFormat != "json" {
+      fmt.Printf("unknown log format '%s'\n", *logFormat)
       os.Exit(1)
    }
 
-   exclusive()
+   if *timePrecision != "us" && *timePrecision != "ns" {
+      fmt.Printf("unknown time precision '%s'\n", *timePrecision)
+      os.Exit(1)
+   }
 
-   // remove any sensors where probe fails
-   for i := len(present)-1; i >= 0; i-- {
-      if !present[i].Present() {
-         present = append(present[:i], present[i+1:]...)
-      }
+   if *clock != "wall" && *clock != "monotonic" {
+      fmt.Printf("unknown clock '%s'\n", *clock)
+      os.Exit(1)
    }
 
-   elems := strings.Split(*events, ",")
-   total := 0
+   switch *handshakeAuth {
+   case "message", "header", "either":
+   default:
+      fmt.Printf("unknown handshake auth '%s'\n", *handshakeAuth)
+      os.Exit(1)
+   }
 
-   for _, sensor := range present {
-      events := sensor.Events()
+   // spectators would otherwise have full control
+   if *spectatorToken != "" && *spectatorToken == *token {
+      fmt.Println("-spectator-token must differ from -token")
+      os.Exit(1)
+   }
 
-      for _, elem := range elems {
-         for i := range events {
-            if events[i].mnemonic == elem {
-               events[i].enabled = true
-               total++
-            }
-         }
+   if *compressLevel < 0 || *compressLevel > 9 {
+      fmt.Printf("compression level %d out of range\n", *compressLevel)
+      os.Exit(1)
+   }
+
+   // routes are registered as base + "/..."
+   *basePath = strings.TrimSuffix(*basePath, "/")
+   if *basePath != "" && !strings.HasPrefix(*basePath, "/") {
+      *basePath = "/" + *basePath
+   }
+
+   for _, elem := range strings.Split(*labelChannels, ",") {
+      name, path, _ := strings.Cut(elem, "=")
+      if *labelChannels != "" && (name == "" || path == "") {
+         fmt.Printf("invalid label channel '%s', expected name=path\n", elem)
+         os.Exit(1)
       }
    }
 
-   Activate()
+   if *recordGaps != "raw" && *recordGaps != "mark" && *recordGaps != "interpolate" {
+      fmt.Printf("unknown gap handling '%s'\n", *recordGaps)
+      os.Exit(1)
+   }
+
+   if *coalesceMode != "time" && *coalesceMode != "count" && *coalesceMode != "hybrid" {
+      fmt.Printf("unknown coalesce mode '%s'\n", *coalesceMode)
+      os.Exit(1)
+   }
+
+   if *interval <= 0 {
+      fmt.Printf("interval must be positive, not %dms\n", *interval)
+      os.Exit(1)
+   }
+
+   clampInterval()
+
+   if *nodeName == "" {
+      *nodeName = hostname()
+   }
+
+   if *listenAddr == "" && *collector == "" {
+      fmt.Println("nothing to serve without a listen address or collector")
+      os.Exit(1)
+   }
+
+   if *signonChunk < 1 {
+      fmt.Println("signon chunk must be at least 1 event")
+      os.Exit(1)
+   }
+
+   if *readHeaderTimeout < 0 || *readTimeout < 0 || *idleTimeout < 0 {
+      fmt.Println("HTTP timeouts can't be negative")
+      os.Exit(1)
+   }
+
+   if *summaryWindow < 0 {
+      fmt.Println("summary window can't be negative")
+      os.Exit(1)
+   }
+
+   if *coalescing < 0 {
+      fmt.Println("coalescing window can't be negative")
+      os.Exit(1)
+   }
+
+   if *coalesceCount < 1 {
+      fmt.Println("coalesce count must be at least 1")
+      os.Exit(1)
+   }
+
+   if *sensorAttempts < 1 {
+      fmt.Println("sensor attempts must be at least 1")
+      os.Exit(1)
+   }
+
+   if *writeStall < 0 {
+      fmt.Println("write stall timeout must not be negative")
+      os.Exit(1)
+   }
+
+   if *maxRequest < 256 {
+      fmt.Println("max request size must be at least 256 bytes")
+      os.Exit(1)
+   }
+
+   if *maxFrameBytes != 0 && *maxFrameBytes < 256 {
+      fmt.Println("max frame size must be at least 256 bytes")
+      os.Exit(1)
+   }
+
+   // talks to another instance, so needs no privileges or sensors
+   if flag.Arg(0) == "ping" {
+      ping(flag.Args()[1:])
+      return
+   }
+
+   if flag.Arg(0) == "verify" {
+      verify(flag.Args()[1:])
+      return
+   }
+
+   // print and exit before taking the pid file or retrying absent sensors
+   if *dumpConfigFlag {
+      setup(1)
+      dumpConfig()
+      return
+   }
+
+   if os.Geteuid() != 0 {
+      fmt.Println("please run with sudo/root")
+      os.Exit(1)
+   }
+
+   exclusive()
+   go reloader()
+
+   total := setup(*sensorAttempts)
+   logSensors()
+
+   err := Activate()
+   validate(err)
+
+   err = checkWidths()
+   validate(err)
 
    if total == 0 {
       fmt.Println("no matching events")
       os.Exit(0)
    }
 
-   unix.Umask(0)
-
-   // expected to fail if already exists
-   _ = unix.Mkfifo(fifoPath, 0666)
+   if overLimit(*discrete) {
+      fmt.Printf("enabled events exceed the limit of %d columns\n", *maxColumns)
+      os.Exit(1)
+   }
 
-   var err error
-   fifo, err = unix.Open(fifoPath, unix.O_RDONLY|unix.O_NONBLOCK, 0)
-   validate(err)
+   if !*noLabels {
+      openChannels()
+   }
 
    if flag.NArg() < 1 {
       flag.Usage()
       os.Exit(1)
    }
 
+   if *pprofAddr != "" {
+      initProfiling(*pprofAddr)
+   }
+
    switch flag.Arg(0) {
    case "stat":
       stat()
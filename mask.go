@@ -0,0 +1,381 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "math"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+)
+
+// hides some of a sensor's sources, so their columns are never sent, and weights
+// the sources when summing them
+type maskedSensor struct {
+   Sensor
+   mutex    sync.Mutex // protects masked, weights and discrete
+   masked   []bool // by source index of the wrapped sensor
+   weights  []float64 // by source index of the wrapped sensor; nil to sum plainly
+   discrete bool
+}
+
+func newMaskedSensor(sensor Sensor) *maskedSensor {
+   return &maskedSensor{Sensor: sensor}
+}
+
+// parses a comma-separated list of source indices to mask
+func parseMask(list string, sources uint) ([]bool, error) {
+   masked := make([]bool, sources)
+   if strings.TrimSpace(list) == "" {
+      return masked, nil
+   }
+
+   n := 0
+
+   for _, elem := range strings.Split(list, ",") {
+      i, err := strconv.Atoi(strings.TrimSpace(elem))
+      if err != nil || i < 0 || i >= int(sources) {
+         return nil, fmt.Errorf("invalid source '%s'", elem)
+      }
+
+      if !masked[i] {
+         masked[i] = true
+         n++
+      }
+   }
+
+   if n == int(sources) {
+      return nil, fmt.Errorf("can't mask every source")
+   }
+
+   return masked, nil
+}
+
+// parses a comma-separated list of a weight per source; nil if all are 1
+func parseWeights(list string, sources uint) ([]float64, error) {
+   if strings.TrimSpace(list) == "" {
+      return nil, nil
+   }
+
+   elems := strings.Split(list, ",")
+   if len(elems) != int(sources) {
+      return nil, fmt.Errorf("%d weights given for %d sources", len(elems), sources)
+   }
+
+   weights := make([]float64, sources)
+   plain := true
+
+   for i, elem := range elems {
+      w, err := strconv.ParseFloat(strings.TrimSpace(elem), 64)
+      if err != nil || math.IsNaN(w) || math.IsInf(w, 0) {
+         return nil, fmt.Errorf("invalid weight '%s'", elem)
+      }
+
+      weights[i] = w
+      plain = plain && w == 1
+   }
+
+   if plain {
+      return nil, nil
+   }
+
+   return weights, nil
+}
+
+// indices in the wrapped sensor of the sources not masked
+func (m *maskedSensor) active() []int {
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   var out []int
+
+   for i := 0; i < int(m.Sensor.Sources()); i++ {
+      if i >= len(m.masked) || !m.masked[i] {
+         out = append(out, i)
+      }
+   }
+
+   return out
+}
+
+func (m *maskedSensor) anyMasked() bool {
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   for _, masked := range m.masked {
+      if masked {
+         return true
+      }
+   }
+
+   return false
+}
+
+func (m *maskedSensor) sourceWeights() []float64 {
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   return m.weights
+}
+
+func (m *maskedSensor) setMask(masked []bool) {
+   m.mutex.Lock()
+   m.masked = masked
+   m.mutex.Unlock()
+}
+
+func (m *maskedSensor) Sources() uint {
+   return uint(len(m.active()))
+}
+
+func (m *maskedSensor) ValueTypes() []valueType {
+   return eventTypes(m.Sensor)
+}
+
+func (m *maskedSensor) HotEnable() bool {
+   h, ok := m.Sensor.(hotEnabler)
+   return ok && h.HotEnable()
+}
+
+// per-unit values are needed from the wrapped sensor to drop the masked ones or
+// weight the sum
+func (m *maskedSensor) Enable(discrete bool) error {
+   m.mutex.Lock()
+   m.discrete = discrete
+   m.mutex.Unlock()
+
+   return m.Sensor.Enable(discrete || m.anyMasked() || m.sourceWeights() != nil)
+}
+
+// the wrapped sensor's headings are per unit whenever masking or weighting
+func (m *maskedSensor) Headings(mnemonics bool) []string {
+   if !m.anyMasked() && m.sourceWeights() == nil {
+      return m.Sensor.Headings(mnemonics)
+   }
+
+   m.mutex.Lock()
+   discrete := m.discrete
+   m.mutex.Unlock()
+
+   active := m.active()
+   var headings []string
+
+   for _, event := range m.Events() {
+      if !event.enabled {
+         continue
+      }
+
+      name := event.desc
+      if mnemonics {
+         name = event.mnemonic
+      }
+
+      if !discrete {
+         headings = append(headings, name)
+         continue
+      }
+
+      for _, i := range active {
+         headings = append(headings, fmt.Sprintf("%s:%d", name, i))
+      }
+   }
+
+   return headings
+}
+
+func (m *maskedSensor) Sample() []int64 {
+   samples := m.Sensor.Sample()
+   weights := m.sourceWeights()
+   if !m.anyMasked() && weights == nil {
+      return samples
+   }
+
+   m.mutex.Lock()
+   discrete := m.discrete
+   m.mutex.Unlock()
+
+   active := m.active()
+   n := int(m.Sensor.Sources())
+   var out []int64
+
+   // values are grouped by event, then source
+   for start := 0; start+n <= len(samples); start += n {
+      var sum int64
+      var weighted float64
+
+      for _, i := range active {
+         if discrete {
+            out = append(out, samples[start+i])
+         } else if weights == nil {
+            sum += samples[start+i]
+         } else {
+            weighted += weights[i] * float64(samples[start+i])
+         }
+      }
+
+      if !discrete && weights != nil {
+         sum = int64(math.Round(weighted))
+      }
+
+      if !discrete {
+         out = append(out, sum)
+      }
+   }
+
+   return out
+}
+
+// 'mask' is a comma-separated list of source indices never to sample, and 'weights'
+// a comma-separated weight per source to multiply values by when summing
+func (m *maskedSensor) Configure(options map[string]string) error {
+   err := m.Sensor.Configure(options)
+   if err != nil {
+      return err
+   }
+
+   if list, ok := options["weights"]; ok {
+      weights, err := parseWeights(list, m.Sensor.Sources())
+      if err != nil {
+         return err
+      }
+
+      m.mutex.Lock()
+      m.weights = weights
+      m.mutex.Unlock()
+   }
+
+   list, ok := options["mask"]
+   if !ok {
+      return nil
+   }
+
+   masked, err := parseMask(list, m.Sensor.Sources())
+   if err != nil {
+      return err
+   }
+
+   m.setMask(masked)
+   return nil
+}
+
+func (m *maskedSensor) Config() map[string]string {
+   out := make(map[string]string)
+   for key, val := range m.Sensor.Config() {
+      out[key] = val
+   }
+
+   m.mutex.Lock()
+   var list []string
+   for i, masked := range m.masked {
+      if masked {
+         list = append(list, strconv.Itoa(i))
+      }
+   }
+
+   var weights []string
+   for _, w := range m.weights {
+      weights = append(weights, strconv.FormatFloat(w, 'g', -1, 64))
+   }
+   m.mutex.Unlock()
+
+   out["mask"] = strings.Join(list, ",")
+   out["weights"] = strings.Join(weights, ",")
+   return out
+}
+
+// index in the sensor of each source sent, which differ from their position once masked
+func sourceIndex(sensor Sensor) []int {
+   if m, ok := sensor.(*maskedSensor); ok {
+      return m.active()
+   }
+
+   out := make([]int, sensor.Sources())
+   for i := range out {
+      out[i] = i
+   }
+
+   return out
+}
+
+// weight of each of a sensor's sources when summing, or nil if they are summed plainly
+func weights(sensor Sensor) []float64 {
+   if m, ok := sensor.(*maskedSensor); ok {
+      return m.sourceWeights()
+   }
+
+   return nil
+}
+
+// changes the sources a sensor masks, restoring the previous mask if it can't apply
+func maskSources(name, list string) *opError {
+   sampling.Lock()
+   defer sampling.Unlock()
+
+   for _, sensor := range present {
+      if sensor.Name() != name {
+         continue
+      }
+
+      m, ok := sensor.(*maskedSensor)
+      if !ok {
+         return &opError{errInvalidValue, fmt.Sprintf("%s can't mask sources", name)}
+      }
+
+      masked, err := parseMask(list, m.Sensor.Sources())
+      if err != nil {
+         return &opError{errInvalidValue, err.Error()}
+      }
+
+      m.mutex.Lock()
+      previous := m.masked
+      m.mutex.Unlock()
+
+      m.setMask(masked)
+
+      if overLimit(*discrete) {
+         m.setMask(previous)
+         return &opError{errLimit, fmt.Sprintf("unmasking would exceed the limit of %d columns", *maxColumns)}
+      }
+
+      m.Lock()
+      err = m.Enable(*discrete)
+      if err != nil {
+         m.setMask(previous)
+         _ = m.Enable(*discrete)
+      }
+      m.Unlock()
+
+      if err != nil {
+         return &opError{errSensor, fmt.Sprintf("%s: %v", name, err)}
+      }
+
+      // values were summed differently, so count from now
+      m.Sample()
+      return nil
+   }
+
+   names := make([]string, len(present))
+   for i, sensor := range present {
+      names[i] = sensor.Name()
+   }
+   sort.Strings(names)
+
+   return &opError{errInvalidValue, fmt.Sprintf("unknown sensor '%s', expected one of %s", name, strings.Join(names, ", "))}
+}
@@ -0,0 +1,125 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "reflect"
+   "testing"
+)
+
+func TestParseMask(t *testing.T) {
+   masked, err := parseMask(" 2,0,2", 3)
+   if err != nil || !reflect.DeepEqual(masked, []bool{true, false, true}) {
+      t.Fatalf("got %v, %v", masked, err)
+   }
+
+   for _, list := range []string{"3", "-1", "x", "0,1,2"} {
+      _, err := parseMask(list, 3)
+      if err == nil {
+         t.Errorf("mask '%s' accepted", list)
+      }
+   }
+}
+
+func TestMaskedSample(t *testing.T) {
+   fake := newFakeSensor()
+   fake.sources = 3
+   fake.events[0].enabled = true
+   fake.events[2].enabled = true
+
+   m := newMaskedSensor(fake)
+   m.setMask([]bool{false, true, false})
+
+   // sums the unmasked sources
+   err := m.Enable(false)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   m.Sample()
+   got := m.Sample()
+   if !reflect.DeepEqual(got, []int64{7 + 9, 10 + 12}) {
+      t.Fatalf("averaged: got %v", got)
+   }
+
+   err = m.Enable(true)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   m.Sample()
+   got = m.Sample()
+   if !reflect.DeepEqual(got, []int64{19, 21, 22, 24}) {
+      t.Fatalf("per-unit: got %v", got)
+   }
+
+   want := []string{"fake0:0", "fake0:2", "fake2:0", "fake2:2"}
+   if headings := m.Headings(true); !reflect.DeepEqual(headings, want) {
+      t.Fatalf("got headings %v, want %v", headings, want)
+   }
+
+   if m.Sources() != 2 || !reflect.DeepEqual(sourceIndex(m), []int{0, 2}) {
+      t.Fatalf("got %d sources, indices %v", m.Sources(), sourceIndex(m))
+   }
+}
+
+func TestWeightedSample(t *testing.T) {
+   for _, list := range []string{"1,2", "1,x,1", "1,NaN,1"} {
+      _, err := parseWeights(list, 3)
+      if err == nil {
+         t.Errorf("weights '%s' accepted", list)
+      }
+   }
+
+   fake := newFakeSensor()
+   fake.sources = 3
+   fake.events[0].enabled = true
+   fake.events[2].enabled = true
+
+   m := newMaskedSensor(fake)
+   err := m.Configure(map[string]string{"weights": "1, 0.5, 2"})
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   err = m.Enable(false)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   m.Sample()
+   got := m.Sample()
+   if !reflect.DeepEqual(got, []int64{7 + 4 + 18, 40}) {
+      t.Fatalf("got %v", got)
+   }
+
+   // a heading per value, as checkWidths() requires
+   if headings := m.Headings(false); len(headings) != len(got) {
+      t.Fatalf("got headings %v for %d values", headings, len(got))
+   }
+
+   if m.Config()["weights"] != "1,0.5,2" || !reflect.DeepEqual(weights(m), []float64{1, 0.5, 2}) {
+      t.Fatalf("got config %v, weights %v", m.Config(), weights(m))
+   }
+
+   // all 1 is a plain sum
+   err = m.Configure(map[string]string{"weights": "1,1,1"})
+   if err != nil || weights(m) != nil {
+      t.Fatalf("got weights %v, %v", weights(m), err)
+   }
+}
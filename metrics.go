@@ -0,0 +1,465 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "io"
+   "net"
+   "net/http"
+   "sort"
+   "sync"
+   "sync/atomic"
+   "time"
+)
+
+type ClientHealth struct {
+   Address      string
+   Connection   string
+   FailedWrites uint64
+   WritingMs    int64 // how long the current write has been blocked, 0 if none
+}
+
+// time taken by a sensor's Sample()
+type SamplingCost struct {
+   Samples   uint64
+   AverageNs int64
+   MaxNs     int64
+}
+
+// time taken handling a client request op
+type OpCost struct {
+   Requests  uint64
+   AverageNs int64
+   MaxNs     int64
+}
+
+// counts of observations at or below each bound, with the last count for larger ones
+type Distribution struct {
+   Bounds []float64
+   Counts []uint64
+   Count  uint64
+   Sum    float64
+}
+
+type Health struct {
+   Status       string
+   FailedWrites uint64
+   Clients      []ClientHealth
+   Sampling     map[string]SamplingCost
+   Ops          map[string]OpCost // by op, with unrecognised ones as 'unknown'
+   FrameEpochs  Distribution
+   FrameBytes   Distribution
+   AuthFailures uint64
+   AuthFailuresByIP map[string]uint64
+   Rejected     map[string]uint64 // by -allow-origins or -allow-user-agents, by header
+}
+
+type sensorCost struct {
+   samples    uint64
+   total      time.Duration
+   max        time.Duration
+   lastWarned time.Time
+}
+
+var (
+   failedWrites uint64 // across all connections, accessed atomically
+   forcedCloses uint64 // connections closed by the watchdog, accessed atomically
+   costs        = map[string]*sensorCost{}
+   costMutex    sync.Mutex
+   frameEpochs  = newDistribution(1, 2, 4, 8, 16, 32, 64)
+   frameBytes   = newDistribution(256, 1024, 4096, 16384, 65536, 262144, 1048576)
+   frameMutex   sync.Mutex
+   authFailures = map[string]uint64{} // by client IP
+   authFailuresTotal uint64
+   authMutex    sync.Mutex
+)
+
+type opStats struct {
+   requests uint64
+   total    time.Duration
+   max      time.Duration
+}
+
+var (
+   ops     = map[string]*opStats{}
+   opMutex sync.Mutex
+)
+
+// records a handled request; ops not recognised should be passed as 'unknown', so
+// clients can't grow the map
+func handled(op string, elapsed time.Duration) {
+   opMutex.Lock()
+   defer opMutex.Unlock()
+
+   stats, ok := ops[op]
+   if !ok {
+      stats = &opStats{}
+      ops[op] = stats
+   }
+
+   stats.requests++
+   stats.total += elapsed
+   if elapsed > stats.max {
+      stats.max = elapsed
+   }
+}
+
+func opCosts() map[string]OpCost {
+   opMutex.Lock()
+   defer opMutex.Unlock()
+
+   out := make(map[string]OpCost, len(ops))
+
+   for op, stats := range ops {
+      out[op] = OpCost{
+         Requests: stats.requests,
+         AverageNs: int64(stats.total) / int64(stats.requests),
+         MaxNs: int64(stats.max),
+      }
+   }
+
+   return out
+}
+
+var (
+   rejections = map[string]uint64{} // by the header which didn't match
+   rejectMutex sync.Mutex
+)
+
+func rejected(header string) {
+   rejectMutex.Lock()
+   rejections[header]++
+   rejectMutex.Unlock()
+}
+
+func rejectionCounts() map[string]uint64 {
+   rejectMutex.Lock()
+   defer rejectMutex.Unlock()
+
+   out := make(map[string]uint64, len(rejections))
+   for header, n := range rejections {
+      out[header] = n
+   }
+
+   return out
+}
+
+// beyond this many IPs, failed handshakes only count towards the total
+const maxAuthIPs = 1024
+
+// counts a handshake with a wrong token from addr
+func authFailed(addr string) {
+   ip, _, err := net.SplitHostPort(addr)
+   if err != nil {
+      ip = addr
+   }
+
+   authMutex.Lock()
+   defer authMutex.Unlock()
+
+   authFailuresTotal++
+
+   if _, ok := authFailures[ip]; ok || len(authFailures) < maxAuthIPs {
+      authFailures[ip]++
+   }
+}
+
+func authFailureCounts() (uint64, map[string]uint64) {
+   authMutex.Lock()
+   defer authMutex.Unlock()
+
+   out := make(map[string]uint64, len(authFailures))
+   for ip, n := range authFailures {
+      out[ip] = n
+   }
+
+   return authFailuresTotal, out
+}
+
+func newDistribution(bounds ...float64) *Distribution {
+   return &Distribution{
+      Bounds: bounds,
+      Counts: make([]uint64, len(bounds)+1),
+   }
+}
+
+func (d *Distribution) observe(val float64) {
+   i := sort.SearchFloat64s(d.Bounds, val)
+   d.Counts[i]++
+   d.Count++
+   d.Sum += val
+}
+
+func (d *Distribution) copy() Distribution {
+   out := *d
+   out.Counts = append([]uint64(nil), d.Counts...)
+   return out
+}
+
+// accounts the size of a data message sent to a client
+func framed(epochs, bytes int) {
+   frameMutex.Lock()
+   frameEpochs.observe(float64(epochs))
+   frameBytes.observe(float64(bytes))
+   frameMutex.Unlock()
+}
+
+func frameSizes() (Distribution, Distribution) {
+   frameMutex.Lock()
+   defer frameMutex.Unlock()
+
+   return frameEpochs.copy(), frameBytes.copy()
+}
+
+// writes a distribution as a Prometheus histogram
+func metricHistogram(w io.Writer, name string, d Distribution) {
+   cumulative := uint64(0)
+
+   for i, bound := range d.Bounds {
+      cumulative += d.Counts[i]
+      fmt.Fprintf(w, "numascope_%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+   }
+
+   fmt.Fprintf(w, "numascope_%s_bucket{le=\"+Inf\"} %d\n", name, d.Count)
+   fmt.Fprintf(w, "numascope_%s_sum %g\n", name, d.Sum)
+   fmt.Fprintf(w, "numascope_%s_count %d\n", name, d.Count)
+}
+
+// accounts time spent sampling, warning if it eats into the interval
+func sampled(name string, elapsed time.Duration) {
+   costMutex.Lock()
+   defer costMutex.Unlock()
+
+   cost, ok := costs[name]
+   if !ok {
+      cost = &sensorCost{}
+      costs[name] = cost
+   }
+
+   debugf("sampling", "sampled %s in %v\n", name, elapsed)
+   cost.samples++
+   cost.total += elapsed
+   if elapsed > cost.max {
+      cost.max = elapsed
+   }
+
+   budget := time.Duration(float64(sampleInterval()) * *sampleBudget * float64(time.Millisecond))
+
+   if *sampleBudget > 0 && elapsed > budget && time.Since(cost.lastWarned) > 10*time.Second {
+      logf("warn", logFields{"sensor": name, "elapsed": elapsed, "budget": budget}, "sampling %s took %v, over %.0f%% of the interval", name, elapsed, *sampleBudget*100)
+      cost.lastWarned = time.Now()
+   }
+}
+
+func samplingCosts() map[string]SamplingCost {
+   costMutex.Lock()
+   defer costMutex.Unlock()
+
+   out := make(map[string]SamplingCost, len(costs))
+
+   for name, cost := range costs {
+      out[name] = SamplingCost{
+         Samples: cost.samples,
+         AverageNs: int64(cost.total) / int64(cost.samples),
+         MaxNs: int64(cost.max),
+      }
+   }
+
+   return out
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+   health := Health{
+      Status: "ok",
+      FailedWrites: atomic.LoadUint64(&failedWrites),
+      Clients: []ClientHealth{},
+      Sampling: samplingCosts(),
+      Ops: opCosts(),
+   }
+
+   health.FrameEpochs, health.FrameBytes = frameSizes()
+   health.AuthFailures, health.AuthFailuresByIP = authFailureCounts()
+   health.Rejected = rejectionCounts()
+
+   for _, c := range clients() {
+      writing := int64(0)
+      if started := atomic.LoadInt64(&c.writing); started != 0 {
+         writing = time.Since(time.Unix(0, started)).Milliseconds()
+      }
+
+      health.Clients = append(health.Clients, ClientHealth{
+         Address: c.addr,
+         Connection: c.id,
+         FailedWrites: atomic.LoadUint64(&c.failed),
+         WritingMs: writing,
+      })
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+   err := json.NewEncoder(w).Encode(&health)
+   if err != nil {
+      debugln("ws", "failed writing:", err)
+   }
+}
+
+// wraps a handler to require the token as a bearer token, if -metrics-auth is given
+func requireMetricsAuth(handler http.HandlerFunc) http.HandlerFunc {
+   return func(w http.ResponseWriter, r *http.Request) {
+      if *metricsAuth && !hasBearer(r, currentToken()) {
+         w.Header().Set("WWW-Authenticate", "Bearer")
+         http.Error(w, "unauthorized", http.StatusUnauthorized)
+         return
+      }
+
+      handler(w, r)
+   }
+}
+
+// serves /healthz and /metrics on their own address, eg an interface only Prometheus can reach
+func initMetrics(addr string) {
+   mux := http.NewServeMux()
+   mux.HandleFunc("/healthz", requireMetricsAuth(healthz))
+   mux.HandleFunc("/metrics", requireMetricsAuth(metrics))
+
+   l, err := net.Listen("tcp", addr)
+   validate(err)
+
+   s := &http.Server{Handler: mux}
+   setTimeouts(s)
+   go s.Serve(l)
+   logf("info", logFields{"addr": addr}, "metrics available at http://%s/metrics", addr)
+}
+
+// writes the help and type lines introducing a metric
+func metricHeader(w io.Writer, name, kind, help string) {
+   fmt.Fprintf(w, "# HELP numascope_%s %s\n", name, help)
+   fmt.Fprintf(w, "# TYPE numascope_%s %s\n", name, kind)
+}
+
+// Prometheus text exposition format
+func metrics(w http.ResponseWriter, r *http.Request) {
+   w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+   conns := clients()
+
+   metricHeader(w, "connections", "gauge", "Connected web clients.")
+   fmt.Fprintf(w, "numascope_connections %d\n", len(conns))
+
+   metricHeader(w, "failed_writes_total", "counter", "Messages which could not be written to a client.")
+   fmt.Fprintf(w, "numascope_failed_writes_total %d\n", atomic.LoadUint64(&failedWrites))
+
+   metricHeader(w, "forced_closes_total", "counter", "Connections closed as a write was blocked for -write-stall.")
+   fmt.Fprintf(w, "numascope_forced_closes_total %d\n", atomic.LoadUint64(&forcedCloses))
+
+   metricHeader(w, "client_failed_writes", "gauge", "Messages which could not be written, per connected client.")
+   for _, c := range conns {
+      fmt.Fprintf(w, "numascope_client_failed_writes{client=%q} %d\n", c.addr, atomic.LoadUint64(&c.failed))
+   }
+
+   total, byIP := authFailureCounts()
+   ips := make([]string, 0, len(byIP))
+   for ip := range byIP {
+      ips = append(ips, ip)
+   }
+   sort.Strings(ips)
+
+   metricHeader(w, "auth_failures_total", "counter", "Websocket handshakes with a wrong token.")
+   fmt.Fprintf(w, "numascope_auth_failures_total %d\n", total)
+
+   metricHeader(w, "ip_auth_failures_total", "counter", "Websocket handshakes with a wrong token, per client IP.")
+   for _, ip := range ips {
+      fmt.Fprintf(w, "numascope_ip_auth_failures_total{ip=%q} %d\n", ip, byIP[ip])
+   }
+
+   metricHeader(w, "rejected_clients_total", "counter", "Websocket clients refused by -allow-origins or -allow-user-agents.")
+   for _, header := range []string{"origin", "user-agent"} {
+      fmt.Fprintf(w, "numascope_rejected_clients_total{header=%q} %d\n", header, rejectionCounts()[header])
+   }
+
+   metricHeader(w, "sensor_present", "gauge", "Whether each sensor was detected at startup.")
+   for _, sensor := range present {
+      fmt.Fprintf(w, "numascope_sensor_present{sensor=%q} 1\n", sensor.Name())
+   }
+   for _, name := range absent {
+      fmt.Fprintf(w, "numascope_sensor_present{sensor=%q} 0\n", name)
+   }
+
+   metricHeader(w, "sensor_sources", "gauge", "Hardware units per detected sensor, eg NumaConnect2 cards.")
+   for _, sensor := range present {
+      fmt.Fprintf(w, "numascope_sensor_sources{sensor=%q} %d\n", sensor.Name(), sensor.Sources())
+   }
+
+   metricHeader(w, "sensor_events", "gauge", "Events supported per detected sensor.")
+   for _, sensor := range present {
+      fmt.Fprintf(w, "numascope_sensor_events{sensor=%q} %d\n", sensor.Name(), len(sensor.Events()))
+   }
+
+   costs := samplingCosts()
+   names := make([]string, 0, len(costs))
+   for name := range costs {
+      names = append(names, name)
+   }
+   sort.Strings(names)
+
+   metricHeader(w, "samples_total", "counter", "Samples taken per sensor.")
+   for _, name := range names {
+      fmt.Fprintf(w, "numascope_samples_total{sensor=%q} %d\n", name, costs[name].Samples)
+   }
+
+   metricHeader(w, "sample_seconds_avg", "gauge", "Average time to sample per sensor.")
+   for _, name := range names {
+      fmt.Fprintf(w, "numascope_sample_seconds_avg{sensor=%q} %g\n", name, time.Duration(costs[name].AverageNs).Seconds())
+   }
+
+   metricHeader(w, "sample_seconds_max", "gauge", "Longest time to sample per sensor.")
+   for _, name := range names {
+      fmt.Fprintf(w, "numascope_sample_seconds_max{sensor=%q} %g\n", name, time.Duration(costs[name].MaxNs).Seconds())
+   }
+
+   opCost := opCosts()
+   opNames := make([]string, 0, len(opCost))
+   for op := range opCost {
+      opNames = append(opNames, op)
+   }
+   sort.Strings(opNames)
+
+   metricHeader(w, "requests_total", "counter", "Client requests handled per op.")
+   for _, op := range opNames {
+      fmt.Fprintf(w, "numascope_requests_total{op=%q} %d\n", op, opCost[op].Requests)
+   }
+
+   metricHeader(w, "request_seconds_avg", "gauge", "Average time to handle a request per op.")
+   for _, op := range opNames {
+      fmt.Fprintf(w, "numascope_request_seconds_avg{op=%q} %g\n", op, time.Duration(opCost[op].AverageNs).Seconds())
+   }
+
+   metricHeader(w, "request_seconds_max", "gauge", "Longest time to handle a request per op.")
+   for _, op := range opNames {
+      fmt.Fprintf(w, "numascope_request_seconds_max{op=%q} %g\n", op, time.Duration(opCost[op].MaxNs).Seconds())
+   }
+
+   epochs, bytes := frameSizes()
+
+   metricHeader(w, "frame_epochs", "histogram", "Samples per data message sent to a client.")
+   metricHistogram(w, "frame_epochs", epochs)
+
+   metricHeader(w, "frame_bytes", "histogram", "Size of data messages sent to a client, before compression.")
+   metricHistogram(w, "frame_bytes", bytes)
+}
@@ -0,0 +1,136 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "net/url"
+   "sort"
+   "strings"
+)
+
+// a sensor and the indices of its events, in the order a client prefers
+type orderedSensor struct {
+   sensor Sensor
+   events []int
+}
+
+// parses the handshake's comma-separated list of sensor names and event mnemonics,
+// each percent-encoded as names may contain spaces
+func parseOrder(list string) []string {
+   var out []string
+
+   for _, elem := range strings.Split(list, ",") {
+      name, err := url.PathUnescape(elem)
+      if err == nil && name != "" {
+         out = append(out, name)
+      }
+   }
+
+   return out
+}
+
+// position of name in a client's preferred order, after every listed name if absent
+func rank(pref []string, name string) int {
+   for i, p := range pref {
+      if p == name {
+         return i
+      }
+   }
+
+   return len(pref)
+}
+
+// sensors and their events with those listed in pref first, in that order, then the
+// rest in the default order
+func ordered(pref []string) []orderedSensor {
+   out := make([]orderedSensor, len(present))
+
+   for i, sensor := range present {
+      events := sensor.Events()
+      indices := make([]int, len(events))
+      for j := range indices {
+         indices[j] = j
+      }
+
+      sort.SliceStable(indices, func(a, b int) bool {
+         return rank(pref, events[indices[a]].mnemonic) < rank(pref, events[indices[b]].mnemonic)
+      })
+
+      out[i] = orderedSensor{sensor, indices}
+   }
+
+   sort.SliceStable(out, func(a, b int) bool {
+      return rank(pref, out[a].sensor.Name()) < rank(pref, out[b].sensor.Name())
+   })
+
+   return out
+}
+
+// values per enabled event of a sensor
+func eventWidth(sensor Sensor, discrete bool) int {
+   if discrete {
+      return int(sensor.Sources())
+   }
+
+   return 1
+}
+
+// index into each epoch of every value sent in the preferred order, starting with the
+// timestamp; with full, disabled events have -1 for each of their values
+func orderedLayout(pref []string, discrete, full bool) []int {
+   // where each event's values are in the default order, or -1 if disabled
+   starts := make(map[Sensor][]int, len(present))
+   column := 1
+
+   for _, sensor := range present {
+      events := sensor.Events()
+      starts[sensor] = make([]int, len(events))
+
+      for i, event := range events {
+         starts[sensor][i] = -1
+
+         if event.enabled {
+            starts[sensor][i] = column
+            column += eventWidth(sensor, discrete)
+         }
+      }
+   }
+
+   layout := []int{0}
+
+   for _, o := range ordered(pref) {
+      n := eventWidth(o.sensor, discrete)
+
+      for _, i := range o.events {
+         start := starts[o.sensor][i]
+         if start < 0 && !full {
+            continue
+         }
+
+         for j := 0; j < n; j++ {
+            if start < 0 {
+               layout = append(layout, -1)
+            } else {
+               layout = append(layout, start+j)
+            }
+         }
+      }
+   }
+
+   return layout
+}
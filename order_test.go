@@ -0,0 +1,100 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "reflect"
+   "strings"
+   "testing"
+
+   "github.com/gorilla/websocket"
+)
+
+// a fake sensor with another name
+type namedSensor struct {
+   *fakeSensor
+   name string
+}
+
+func (d namedSensor) Name() string {
+   return d.name
+}
+
+func TestOrderedLayout(t *testing.T) {
+   a := namedSensor{newFakeSensor(), "a"}
+   a.events[0].enabled = true
+   a.events[2].enabled = true
+   b := namedSensor{newFakeSensor(), "b"}
+   b.events[1].enabled = true
+   present = []Sensor{a, b}
+
+   // epochs hold a's fake0 and fake2, then b's fake1
+   pref := parseOrder("b,fake2,no%20such")
+   if !reflect.DeepEqual(pref, []string{"b", "fake2", "no such"}) {
+      t.Fatalf("parsed %q", pref)
+   }
+
+   if got := orderedLayout(nil, false, false); !reflect.DeepEqual(got, []int{0, 1, 2, 3}) {
+      t.Errorf("default: got %v", got)
+   }
+
+   if got := orderedLayout(pref, false, false); !reflect.DeepEqual(got, []int{0, 3, 2, 1}) {
+      t.Errorf("preferred: got %v", got)
+   }
+
+   if got := orderedLayout(pref, false, true); !reflect.DeepEqual(got, []int{0, -1, -1, 3, 2, 1, -1}) {
+      t.Errorf("full: got %v", got)
+   }
+
+   // per-unit values stay together
+   if got := orderedLayout(pref, true, false); !reflect.DeepEqual(got, []int{0, 5, 6, 3, 4, 1, 2}) {
+      t.Errorf("discrete: got %v", got)
+   }
+}
+
+func TestOrderHandshake(t *testing.T) {
+   sensor := newFakeSensor()
+   sensor.events[0].enabled = true
+   sensor.events[2].enabled = true
+   present = []Sensor{sensor}
+   resetConnections()
+
+   server := testServer(t, monitor)
+   defer server.Close()
+
+   client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer client.Close()
+
+   client.WriteMessage(websocket.TextMessage, []byte(*token+" order=fake2"))
+
+   var signon SignonMessage
+   err = client.ReadJSON(&signon)
+   if err != nil || !reflect.DeepEqual(signon.Tree["fake"], []string{"fake event 2", "fake event 0", "fake event 1"}) {
+      t.Fatalf("got %+v, %v", signon.Tree, err)
+   }
+
+   var change ChangeMessage
+   err = client.ReadJSON(&change)
+   if err != nil || !reflect.DeepEqual(change.Enabled["fake"], []string{"fake event 2", "fake event 0"}) ||
+      !reflect.DeepEqual(change.Index["fake"], []int{1, 2}) {
+      t.Fatalf("got %+v, %v", change, err)
+   }
+}
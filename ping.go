@@ -0,0 +1,125 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "net/url"
+   "os"
+   "sort"
+   "strings"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// websocket URL for a host:port or http URL of a running instance
+func monitorURL(addr string) (string, error) {
+   if !strings.Contains(addr, "://") {
+      addr = "http://" + addr
+   }
+
+   u, err := url.Parse(addr)
+   if err != nil {
+      return "", err
+   }
+
+   switch u.Scheme {
+   case "http", "ws":
+      u.Scheme = "ws"
+   case "https", "wss":
+      u.Scheme = "wss"
+   default:
+      return "", fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+   }
+
+   u.Path = strings.TrimSuffix(u.Path, "/") + "/monitor"
+   return u.String(), nil
+}
+
+// connects to a running instance, prints what it reports and disconnects
+func ping(args []string) {
+   if len(args) != 1 {
+      fmt.Println("syntax: ping <host[:port][/base-path]>")
+      os.Exit(1)
+   }
+
+   target, err := monitorURL(args[0])
+   validate(err)
+
+   dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+   socket, _, err := dialer.Dial(target, nil)
+   if err != nil {
+      fmt.Printf("%s: %v\n", target, err)
+      os.Exit(1)
+   }
+   defer socket.Close()
+
+   err = socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+   validate(err)
+
+   err = socket.WriteMessage(websocket.TextMessage, []byte(*token))
+   validate(err)
+
+   var signon SignonMessage
+   err = socket.ReadJSON(&signon)
+   if err != nil {
+      fmt.Printf("%s: signon failed: %v\n", target, err)
+      os.Exit(1)
+   }
+
+   fmt.Printf("%s: node %s, protocol version %d, timestamps in %s\n", target, signon.NodeName, signon.Version, signon.Precision)
+
+   for _, name := range signon.Order {
+      fmt.Printf("  %s: %d events, %d sources, options %v\n", name, len(signon.Tree[name]), signon.Sources[name], signon.Config[name])
+   }
+
+   err = socket.WriteJSON(map[string]string{"Op": "config"})
+   validate(err)
+
+   // skip the change, data and other messages sent meanwhile
+   for {
+      _, message, err := socket.ReadMessage()
+      if err != nil {
+         fmt.Printf("%s: no config reply: %v\n", target, err)
+         os.Exit(1)
+      }
+
+      var reply ConfigMessage
+      if json.Unmarshal(message, &reply) != nil || reply.Op != "config" {
+         continue
+      }
+
+      names := make([]string, 0, len(reply.Settings))
+      for name := range reply.Settings {
+         names = append(names, name)
+      }
+      sort.Strings(names)
+
+      fmt.Println("settings:")
+      for _, name := range names {
+         fmt.Printf("  %s=%s\n", name, reply.Settings[name])
+      }
+
+      break
+   }
+
+   _ = socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
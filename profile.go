@@ -0,0 +1,41 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "net/http"
+   "net/http/pprof"
+)
+
+// serves profiles on a separate address, so they aren't exposed with the web interface
+func initProfiling(addr string) {
+   mux := http.NewServeMux()
+   // no cmdline handler, as the command line may carry tokens
+   mux.HandleFunc("/debug/pprof/", pprof.Index)
+   mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+   mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+   mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+   go func() {
+      err := http.ListenAndServe(addr, mux)
+      logf("error", logFields{"error": err.Error()}, "profiling stopped: %v", err)
+   }()
+
+   logf("info", logFields{"addr": addr}, "profiling available at http://%s/debug/pprof/", addr)
+}
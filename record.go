@@ -19,15 +19,21 @@ package main
 
 import (
    "bytes"
+   "compress/gzip"
    "encoding/json"
+   "errors"
    "fmt"
+   "hash"
+   "hash/crc32"
    "io"
    "os"
    "os/exec"
    "os/signal"
    "path"
+   "reflect"
    "strconv"
    "strings"
+   "sync"
    "syscall"
    "time"
 
@@ -35,16 +41,37 @@ import (
 )
 
 var (
-   file *os.File
+   file        *os.File
+   fileName    string
+   fileBytes   int64
+   fileOpened  time.Time
+   compressing sync.WaitGroup
+   lastLine    []int64 // previous sample written to this file
+   fileHeadings []string // columns of the samples being written
+   fileCRC     hash.Hash32 // of everything written to this file
+   fileRows    int // samples written to this file
+   rotateStamp string // timestamp of the last rotation
+   rotateSeq   int // rotations within rotateStamp
 )
 
-func writeLabel(timestamp int64, label string) {
+func fileWrite(b []byte) {
+   n, err := file.Write(b)
+   validate(err)
+   fileBytes += int64(n)
+   fileCRC.Write(b[:n])
+}
+
+func writeLabel(timestamp int64, channel, label string) {
    elems := []interface{}{"label", timestamp, label}
+   if channel != "" {
+      elems = append(elems, channel)
+   }
+
    b, err := json.Marshal(elems)
    validate(err)
    b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
-   validate(err)
+   fileWrite(b)
+   traceLabel(timestamp, channel, label)
 }
 
 func fileStop() {
@@ -52,28 +79,31 @@ func fileStop() {
       return
    }
 
-   // trim trailing ','
-   _, err := file.Seek(-2, io.SeekCurrent)
-   validate(err)
-
-   _, err = file.WriteString("\n]\n")
+   // so a loader can tell the file is complete and intact
+   footer := fmt.Sprintf("[\"end\",%d,\"%08x\"]\n]\n", fileRows, fileCRC.Sum32())
+   _, err := file.WriteString(footer)
    validate(err)
 
    err = file.Close()
    validate(err)
+   file = nil
 }
 
 func fileStart() {
+   fileOpen(*recordFile)
+}
+
+func fileOpen(name string) {
    fileStop()
 
    var err error
-   fileNameFull := *recordFile
+   fileNameFull := name
    index := 0
 
 again:
    if index > 0 {
-      ext := path.Ext(*recordFile)
-      leaf := strings.TrimSuffix(*recordFile, ext)
+      ext := path.Ext(name)
+      leaf := strings.TrimSuffix(name, ext)
       fileNameFull = fmt.Sprintf("%s_%d%s", leaf, index, ext)
    }
 
@@ -89,20 +119,95 @@ again:
    }
 
    validate(err)
+   fileName = fileNameFull
+   fileBytes = 0
+   fileOpened = time.Now()
+   fileCRC = crc32.NewIEEE()
+   fileRows = 0
+   lastLine = nil
+
+   header := fmt.Sprintf("[[\"%s\",%d,%d,\"%s\"],\n", primary.Name(), primary.Sources(), primary.Rate(), *timePrecision)
+   if *clock == "monotonic" {
+      // origin follows, to map timestamps to wall time
+      header = fmt.Sprintf("[[\"%s\",%d,%d,\"%s\",%d],\n", primary.Name(), primary.Sources(), primary.Rate(), *timePrecision, origin())
+   }
+   fileWrite([]byte(header))
 
-   header := fmt.Sprintf(`[["%s",%d,%d],\n`, present[0].Name(), present[0].Sources(), present[0].Rate())
-   _, err = file.WriteString(header)
-   validate(err)
-
-   headings := present[0].Headings(false)
+   headings := primary.Headings(false)
+   fileHeadings = headings
    b, err := json.Marshal(headings)
    validate(err)
 
    b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
+   fileWrite(b)
+
+   ms := intervalSetting()
+   logf("info", logFields{"file": fileNameFull, "interval": ms}, "recording to %v with %dms sample interval", fileNameFull, ms)
+}
+
+func needRotate() bool {
+   if *rotateSize > 0 && fileBytes >= *rotateSize {
+      return true
+   }
+
+   return *rotateInterval > 0 && time.Since(fileOpened) >= *rotateInterval
+}
+
+// closes the current file and continues in a new timestamped one
+func rotate() {
+   previous := fileName
+   fileStop()
+
+   if *rotateGzip {
+      compressing.Add(1)
+
+      go func() {
+         defer compressing.Done()
+         gzipFile(previous)
+      }()
+   }
+
+   fileOpen(rotateName(time.Now()))
+}
+
+// names the next rotated file; rotations within the same second are numbered, so
+// one neither truncates a file still being compressed nor clashes with its .gz
+func rotateName(now time.Time) string {
+   ext := path.Ext(*recordFile)
+   leaf := strings.TrimSuffix(*recordFile, ext)
+   stamp := now.Format("20060102-150405")
+
+   if stamp != rotateStamp {
+      rotateStamp = stamp
+      rotateSeq = 0
+      return fmt.Sprintf("%s_%s%s", leaf, stamp, ext)
+   }
+
+   rotateSeq++
+   return fmt.Sprintf("%s_%s-%d%s", leaf, stamp, rotateSeq, ext)
+}
+
+// replaces a file with a gzipped copy
+func gzipFile(name string) {
+   in, err := os.Open(name)
+   validate(err)
+   defer in.Close()
+
+   out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0444)
+   validate(err)
+
+   w := gzip.NewWriter(out)
+   _, err = io.Copy(w, in)
+   validate(err)
+
+   err = w.Close()
    validate(err)
 
-   fmt.Printf("recording to %v with %dms sample interval\n", fileNameFull, *interval)
+   err = out.Close()
+   validate(err)
+
+   err = os.Remove(name)
+   validate(err)
 }
 
 func setInterval(input string) {
@@ -127,36 +232,205 @@ func setInterval(input string) {
       return
    }
 
-   *interval = i
+   if i <= 0 {
+      fmt.Printf("interval must be positive\n")
+      return
+   }
+
+   setIntervalSetting(i)
 }
 
-func sample() {
-   line := []int64{time.Now().UnixNano() / 1e3}
-   line = append(line, present[0].Sample()...)
+// samples linearly interpolated between two, if more than one interval apart
+func interpolate(last, line []int64, period int64) [][]int64 {
+   if last == nil || len(last) != len(line) {
+      return nil
+   }
 
-   b, err := json.Marshal(line)
-   validate(err)
+   // tolerate sampling jitter
+   steps := (line[0] - last[0] + period/2) / period
+   var out [][]int64
+
+   for i := int64(1); i < steps; i++ {
+      fill := make([]int64, len(line))
+
+      // in floating point, as the product can overflow with large counts or long gaps
+      for j := range line {
+         fill[j] = last[j] + int64(float64(line[j] - last[j]) * float64(i) / float64(steps))
+      }
+
+      out = append(out, fill)
+   }
+
+   return out
+}
+
+func writeLine(line []int64) {
+   floats := append([]bool{false}, sensorFloats(primary, *discrete)...)
+   b := appendEpoch(nil, line, floats, 0, false)
    b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
-   validate(err)
+   fileWrite(b)
+   fileRows++
+   traceCounters(line, fileHeadings, floats)
+}
+
+// checks a recording's footer against its contents, returning the number of samples
+func verifyRecording(content []byte) (int, error) {
+   start := bytes.LastIndex(content, []byte("\n[\"end\","))
+   if start < 0 {
+      return 0, errors.New("no footer, so incomplete")
+   }
+   start++
+
+   end := bytes.IndexByte(content[start:], '\n')
+   if end < 0 || strings.TrimSpace(string(content[start+end:])) != "]" {
+      return 0, errors.New("data after footer")
+   }
+
+   var footer []interface{}
+   err := json.Unmarshal(content[start:start+end], &footer)
+   if err != nil || len(footer) != 3 {
+      return 0, fmt.Errorf("malformed footer")
+   }
+
+   rows, _ := footer[1].(float64)
+   sum, _ := footer[2].(string)
+
+   if actual := fmt.Sprintf("%08x", crc32.ChecksumIEEE(content[:start])); actual != sum {
+      return 0, fmt.Errorf("checksum %s, expected %s", actual, sum)
+   }
+
+   var entries [][]interface{}
+   err = json.Unmarshal(content, &entries)
+   if err != nil {
+      return 0, err
+   }
+
+   samples := 0
+   for _, entry := range entries[1:] {
+      if _, ok := entry[0].(float64); ok {
+         samples++
+      }
+   }
+
+   if samples != int(rows) {
+      return 0, fmt.Errorf("%d samples, expected %d", samples, int(rows))
+   }
+
+   return samples, nil
+}
+
+// reports whether recordings, optionally gzipped, are complete and intact
+func verify(names []string) {
+   if len(names) == 0 {
+      fmt.Println("syntax: verify <filename.json>..")
+      os.Exit(1)
+   }
+
+   failed := false
+
+   for _, name := range names {
+      content, err := readRecording(name)
+      if err == nil {
+         var rows int
+         rows, err = verifyRecording(content)
+
+         if err == nil {
+            fmt.Printf("%s: ok, %d samples\n", name, rows)
+            continue
+         }
+      }
+
+      fmt.Printf("%s: %v\n", name, err)
+      failed = true
+   }
+
+   if failed {
+      os.Exit(1)
+   }
+}
+
+func readRecording(name string) ([]byte, error) {
+   f, err := os.Open(name)
+   if err != nil {
+      return nil, err
+   }
+   defer f.Close()
+
+   var r io.Reader = f
+   if strings.HasSuffix(name, ".gz") {
+      gz, err := gzip.NewReader(f)
+      if err != nil {
+         return nil, err
+      }
+      r = gz
+   }
+
+   return io.ReadAll(r)
+}
+
+func sample() {
+   line := []int64{now()}
+
+   // mark where the columns change, so following samples can be attributed
+   headings := primary.Headings(false)
+   if !reflect.DeepEqual(headings, fileHeadings) {
+      b, err := json.Marshal([]interface{}{"columns", line[0], headings})
+      validate(err)
+      fileWrite(append(b, []byte(",\n")...))
+
+      fileHeadings = headings
+      lastLine = nil
+   }
+
+   line = append(line, primary.Sample()...)
+
+   for _, name := range takeResets() {
+      writeLabel(line[0], "", name+" counter reset")
+   }
+
+   period := int64(intervalSetting()) * 1e6 / timeUnit()
+   gap := interpolate(lastLine, line, period)
+
+   if len(gap) > 0 {
+      switch *recordGaps {
+      case "mark":
+         b, err := json.Marshal([]interface{}{"gap", lastLine[0], line[0]})
+         validate(err)
+         fileWrite(append(b, []byte(",\n")...))
+      case "interpolate":
+         for _, fill := range gap {
+            writeLine(fill)
+         }
+      }
+   }
+
+   writeLine(line)
+   lastLine = line
+
+   if needRotate() {
+      rotate()
+   }
 }
 
 func delay() {
-   time.Sleep(time.Duration(*interval) * time.Millisecond)
+   time.Sleep(time.Duration(intervalSetting()) * time.Millisecond)
 }
 
 func record(args []string) {
    // always capture per-chip counters
    *discrete = true
-   present[0].Enable(*discrete)
 
    // enable all events
-   events := present[0].Events()
+   events := primary.Events()
    for i := range events {
       events[i].enabled = true
    }
 
-   Activate()
+   err := Activate()
+   validate(err)
+
+   err = checkWidths()
+   validate(err)
 
    sigs := make(chan os.Signal, 1)
    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -164,6 +438,10 @@ func record(args []string) {
    fileStart()
    fifoBuf := make([]byte, 256)
 
+   if *traceOut != "" {
+      traceOpen(*traceOut)
+   }
+
    // launch any command
    exitStatus := make(chan error)
 
@@ -191,16 +469,14 @@ outer:
          break outer
       case <-exitStatus:
          break outer
-      case <-time.After(time.Duration(*interval) * time.Millisecond):
+      case <-time.After(time.Duration(intervalSetting()) * time.Millisecond):
       }
 
       // handle command
-      n, err := unix.Read(fifo, fifoBuf)
-      validateNonblock(err)
+      line := pendingLabel(fifoBuf)
 
-      if n > 0 {
-         timestamp := time.Now().UnixNano() / 1e3
-         line := string(bytes.TrimSpace(fifoBuf[:n]))
+      if line != "" {
+         timestamp := now()
          fields := strings.SplitN(line, " ", 2)
 
          switch fields[0] {
@@ -213,7 +489,9 @@ outer:
             }
          case "label":
             if len(fields) >= 2 {
-               writeLabel(timestamp, fields[1])
+               if !repeated("", fields[1], time.Now()) {
+                  writeLabel(timestamp, "", fields[1])
+               }
             } else {
                fmt.Println("syntax: label <label>..")
             }
@@ -232,6 +510,12 @@ outer:
          }
       }
 
+      for _, l := range channelLabels(fifoBuf) {
+         if !repeated(l.channel, l.label, time.Now()) {
+            writeLabel(now(), l.channel, l.label)
+         }
+      }
+
       sample()
    }
 
@@ -242,4 +526,6 @@ outer:
    }
 
    fileStop()
+   traceClose()
+   compressing.Wait()
 }
@@ -0,0 +1,180 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "bytes"
+   "encoding/json"
+   "os"
+   "path/filepath"
+   "reflect"
+   "testing"
+   "time"
+)
+
+func TestInterpolate(t *testing.T) {
+   // on time, with jitter
+   if gap := interpolate([]int64{1000, 10}, []int64{1120, 20}, 100); gap != nil {
+      t.Fatalf("got %v, want no gap", gap)
+   }
+
+   // two samples missed
+   gap := interpolate([]int64{1000, 10, 0}, []int64{1300, 40, 300}, 100)
+   want := [][]int64{{1100, 20, 100}, {1200, 30, 200}}
+   if !reflect.DeepEqual(gap, want) {
+      t.Fatalf("got %v, want %v", gap, want)
+   }
+
+   // large counts mustn't overflow
+   gap = interpolate([]int64{1000, 0}, []int64{1300, 6 << 60}, 100)
+   want = [][]int64{{1100, 2 << 60}, {1200, 4 << 60}}
+   if !reflect.DeepEqual(gap, want) {
+      t.Fatalf("got %v, want %v", gap, want)
+   }
+}
+
+func TestRecordColumnsChange(t *testing.T) {
+   sensor := newFakeSensor()
+   primary = sensor
+   events := sensor.Events()
+   events[0].enabled = true
+   sensor.Enable(false)
+
+   name := filepath.Join(t.TempDir(), "test.json")
+   fileOpen(name)
+   sample()
+
+   // enabled mid-recording
+   events[2].enabled = true
+   sensor.Enable(false)
+   sample()
+   fileStop()
+
+   content, err := os.ReadFile(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var entries []interface{}
+   err = json.Unmarshal(content, &entries)
+   if err != nil {
+      t.Fatalf("%s: %v", content, err)
+   }
+
+   // header, headings, sample, marker, sample, footer
+   if len(entries) != 6 {
+      t.Fatalf("got %d entries: %s", len(entries), content)
+   }
+
+   marker := entries[3].([]interface{})
+   if marker[0] != "columns" || !reflect.DeepEqual(marker[2], []interface{}{"fake0", "fake2"}) {
+      t.Fatalf("got marker %v", marker)
+   }
+
+   if len(entries[4].([]interface{})) != 3 {
+      t.Fatalf("got sample %v after marker", entries[4])
+   }
+}
+
+func TestRotateName(t *testing.T) {
+   saved := *recordFile
+   defer func() {
+      *recordFile = saved
+      rotateStamp, rotateSeq = "", 0
+   }()
+
+   *recordFile = "out.json"
+   now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+   want := []string{"out_20240102-030405.json", "out_20240102-030405-1.json", "out_20240102-030405-2.json"}
+   for i, name := range want {
+      if got := rotateName(now.Add(time.Duration(i) * time.Millisecond)); got != name {
+         t.Fatalf("rotation %d: got %s, want %s", i, got, name)
+      }
+   }
+
+   if got := rotateName(now.Add(time.Second)); got != "out_20240102-030406.json" {
+      t.Fatalf("got %s after a second", got)
+   }
+}
+
+func TestVerifyRecording(t *testing.T) {
+   sensor := newFakeSensor()
+   primary = sensor
+   sensor.Events()[0].enabled = true
+   sensor.Enable(false)
+
+   name := filepath.Join(t.TempDir(), "test.json")
+   fileOpen(name)
+   sample()
+   sample()
+   fileStop()
+
+   content, err := os.ReadFile(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   rows, err := verifyRecording(content)
+   if rows != 2 || err != nil {
+      t.Fatalf("got %d samples, %v", rows, err)
+   }
+
+   // a value changed in place
+   corrupt := bytes.Replace(content, []byte(",-1]"), []byte(",-2]"), 1)
+   if _, err := verifyRecording(corrupt); err == nil {
+      t.Fatal("corruption not detected")
+   }
+
+   truncated := content[:bytes.LastIndex(content, []byte("[\"end\""))]
+   if _, err := verifyRecording(truncated); err == nil {
+      t.Fatal("truncation not detected")
+   }
+}
+
+func TestTraceOut(t *testing.T) {
+   sensor := newFakeSensor()
+   primary = sensor
+   sensor.Events()[0].enabled = true
+   sensor.Enable(false)
+
+   dir := t.TempDir()
+   fileOpen(filepath.Join(dir, "test.json"))
+   traceOpen(filepath.Join(dir, "trace.json"))
+   sample()
+   writeLabel(now(), "phases", "phase 1")
+   fileStop()
+   traceClose()
+
+   content, err := os.ReadFile(filepath.Join(dir, "trace.json"))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var events []map[string]interface{}
+   err = json.Unmarshal(content, &events)
+   if err != nil {
+      t.Fatalf("%s: %v", content, err)
+   }
+
+   // metadata, counter, label
+   if len(events) != 3 || events[1]["ph"] != "C" || events[1]["name"] != "fake0" || events[2]["ph"] != "i" || events[2]["name"] != "phase 1" {
+      t.Fatalf("got %s", content)
+   }
+}
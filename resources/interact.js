@@ -31,16 +31,26 @@ let portGroup = true
 let unitGroup = true
 let socket
 let signedon
+let pending // signon being assembled from parts
 let sources
+let sourceIndex = {} // index of each source sent, as some may be masked
 let scrolling = true
 let listened = false
 let stopped = false
 let discrete = false
 let timestamp = Date.now()
 let interval = 100 // milliseconds
+let tsScale = 1e3 // timestamp units per millisecond
+let tsOrigin = 0 // added to monotonic timestamps for wall time
+let hints = {} // per sensor, display hints by event
 let offline = false
 let filter
 let headings = []
+let maxColumns = 0
+let retryDelay = 1e3 // milliseconds
+let retryTimer
+let continued = ''
+const token = new URLSearchParams(location.search).get('token') || '463ba1974b06'
 
 const defaultTraces = {
    NumaConnect2: '% wait cycles',
@@ -77,16 +87,28 @@ const layout = {
 }
 
 function connect() {
-   socket = new WebSocket('ws://'+location.host+'/monitor')
+   clearTimeout(retryTimer)
+   // relative to the page, which may be served under a path prefix
+   const url = new URL('monitor', location.href)
+   url.protocol = 'ws:'
+   url.search = ''
+   socket = new WebSocket(url, 'numascope.v1')
 
    socket.onmessage = receive
    socket.onopen = function(e) {
       signedon = false
-      socket.send('463ba1974b06')
+      socket.send(token+' chunked')
    }
 
    socket.onclose = function(e) {
       $('#connecting').show()
+
+      // honour any hint from the server, otherwise back off exponentially
+      const hint = /retry-after=(\d+)/.exec(e.reason)
+      const delay = hint ? Number(hint[1]) * 1e3 : retryDelay
+      retryDelay = Math.min(retryDelay * 2, 60e3)
+      clearTimeout(retryTimer)
+      retryTimer = setTimeout(connect, delay)
    }
 }
 
@@ -113,14 +135,38 @@ function relayout() {
 
 function enabled(msg) {
    var elem = document.getElementById('data-interval')
-   elem.parentElement.nextSibling.data = ' '+msg.Interval+'ms'
+   let text = ' '+msg.Interval+'ms'
+
+   // show when sampling falls behind what was requested
+   if (msg.Achieved > msg.Interval * 1.1)
+      text += ' (achieving '+Math.round(msg.Achieved)+'ms)'
+
+   if (msg.Paused)
+      text += ' (sampling paused)'
+
+   // others may be changing global settings too
+   if (msg.Clients > 1)
+      text += ', '+msg.Clients+' viewers'
+
+   elem.parentElement.nextSibling.data = text
    elem.value = Math.log2(msg.Interval)
 
    discrete = msg.Discrete
    radServerGroup.checked = !discrete
 
-   for (let btn of buttons)
-      btn.className = subset(msg.Enabled, btn.firstChild.nodeValue) ? 'btn btn-primary btn-sm m-1' : 'btn btn-light btn-sm m-1'
+   if (msg.SourceIndex) {
+      sourceIndex = msg.SourceIndex
+      for (const sensor in sourceIndex)
+         sources[sensor] = sourceIndex[sensor].length
+   }
+
+   const full = maxColumns > 0 && msg.Columns >= maxColumns
+
+   for (let btn of buttons) {
+      const on = subset(msg.Enabled, btn.firstChild.nodeValue)
+      btn.className = on ? 'btn btn-primary btn-sm m-1' : 'btn btn-light btn-sm m-1'
+      btn.disabled = full && !on
+   }
 
    let data = []
    let total = 0
@@ -133,12 +179,13 @@ function enabled(msg) {
          if (discrete && sources[sensor] > 1) {
             for (let i = 0; i < sources[sensor]; i++) {
                data.push({
-                  name: heading+':'+i,
+                  name: heading+':'+(sourceIndex[sensor] ? sourceIndex[sensor][i] : i),
                   type: 'scatter',
                   mode: 'lines',
                   hoverlabel: {namelength: 80},
                   x: [], y: [],
                   yaxis: heading[0] == '%' ? 'y2' : 'y1',
+                  line: lineHint(sensor, heading),
 //                  visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
                })
             }
@@ -150,6 +197,7 @@ function enabled(msg) {
                hoverlabel: {namelength: 80},
                x: [], y: [],
                yaxis: (heading[0] == '%') ? 'y2' : 'y1',
+               line: lineHint(sensor, heading),
 //               visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
             })
          }
@@ -168,9 +216,9 @@ function enabled(msg) {
 
 function label(elem) {
    annotations.push({
-      x: new Date(elem.Timestamp / 1e3),
+      x: new Date((elem.Timestamp + tsOrigin) / tsScale),
       y: 0,
-      text: elem.Label,
+      text: elem.Channel ? elem.Channel+': '+elem.Label : elem.Label,
       arrowhead: 3,
       ax: 0,
       ay: 40
@@ -179,6 +227,11 @@ function label(elem) {
    Plotly.relayout(graph, {annotations: annotations})
 }
 
+function showError(elem) {
+   $('#error-text').text(elem.Message)
+   $('#error').show()
+}
+
 function update(elem) {
    const indicies = []
    const x = []
@@ -190,14 +243,15 @@ function update(elem) {
       y.push([])
    }
 
-   timestamp = elem[elem.length-1][0] / 1e3
+   timestamp = (elem[elem.length-1][0] + tsOrigin) / tsScale
 
    for (const update of elem) {
-      const time = new Date(update[0] / 1e3)
+      const time = new Date((update[0] + tsOrigin) / tsScale)
 
+      // large values may arrive as strings
       for (let i = 1; i < update.length; i++) {
          x[i-1].push(time)
-         y[i-1].push(update[i])
+         y[i-1].push(Number(update[i]))
       }
    }
 
@@ -312,11 +366,22 @@ function reduce(ents) {
    return out
 }
 
+// trace line style from the event's display hints, if any
+function lineHint(sensor, heading) {
+   const hint = hints[sensor] && hints[sensor][heading]
+   return hint && hint.color ? {color: hint.color} : {}
+}
+
 function signon(elem) {
    $('#connecting').hide()
    $('#loading').hide()
+   retryDelay = 1e3
 
    sources = elem.Sources
+   tsScale = elem.Precision == 'ns' ? 1e6 : 1e3
+   tsOrigin = elem.Origin || 0
+   hints = elem.Hints || {}
+   maxColumns = elem.MaxColumns
    reset()
 
    const container = document.querySelector('#events')
@@ -346,9 +411,46 @@ function signon(elem) {
 function receive(e) {
    let input = JSON.parse(e.data)
 
+   // large sensor trees arrive in parts
+   if (pending) {
+      if (input.Op == 'signon-part') {
+         const sensor = input.Sensor
+         pending.Tree[sensor] = (pending.Tree[sensor] || []).concat(input.Events)
+         pending.Types[sensor] = (pending.Types[sensor] || []).concat(input.Types)
+         pending.Sources[sensor] = input.Sources
+         pending.Config[sensor] = input.Config
+         if (input.Hints)
+            pending.Hints[sensor] = Object.assign(pending.Hints[sensor] || {}, input.Hints)
+         return
+      }
+
+      if (input.Op == 'signon-complete') {
+         input = pending
+         pending = null
+      }
+   }
+
    if (signedon == false) {
+      if (input.Chunked) {
+         pending = input
+         pending.Chunked = false
+         pending.Tree = {}
+         pending.Types = {}
+         pending.Sources = {}
+         pending.Config = {}
+         pending.Hints = {}
+         return
+      }
+
       signon(input)
       signedon = true
+
+      // restore this tab's settings from before a reconnect
+      const previous = sessionStorage.getItem('session')
+      if (previous && input.Session)
+         socket.send(JSON.stringify({Op: 'resume', Session: previous}))
+      if (input.Session)
+         sessionStorage.setItem('session', input.Session)
       return
    }
 
@@ -356,6 +458,18 @@ function receive(e) {
       enabled(input)
    else if (input.Op == 'label')
       label(input)
+   else if (input.Op == 'error')
+      showError(input)
+   else if (input.Op == 'continued') {
+      // reassemble oversized data messages
+      continued += input.Data
+
+      if (!input.More) {
+         update(JSON.parse(continued))
+         continued = ''
+      }
+   } else if (input.Op == 'heartbeat')
+      return // only shows the connection is alive
    else
       update(input)
 }
@@ -442,16 +556,8 @@ function parse(file) {
    }
 
    let technology = json[0][0]
-
-   switch(technology) {
-   case 'NumaConnect2':
-      headings = filterNC2(json[1])
-      break
-   case 'UNC':
-      headings = filterUNC(json[1])
-//      grouping.appendChild(button('PE unit'))
-      break
-   }
+   tsScale = json[0][3] == 'ns' ? 1e6 : 1e3
+   tsOrigin = json[0][4] || 0
 
    normalise = json[0][2] / 100
    reset()
@@ -466,26 +572,51 @@ function parse(file) {
    subtree.appendChild(button('all', false))
 
    const totals = []
+   const traces = {} // index into data by heading
+   let columns = [] // index into data of each heading
+
+   // reduces the recorded column list, adding traces for headings not seen before
+   function setColumns(list) {
+      switch(technology) {
+      case 'NumaConnect2':
+         headings = filterNC2(list)
+         break
+      case 'UNC':
+         headings = filterUNC(list)
+//         grouping.appendChild(button('PE unit'))
+         break
+      }
 
-   for (const heading of headings) {
-      data.push({
-         name: heading,
-         type: 'scatter',
-         mode: 'lines',
-         hoverlabel: {namelength: 80},
-         x: [], y: [],
-         yaxis: (heading[0] == '%') ? 'y2' : 'y1',
-         visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
-      })
+      columns = headings.map(heading => {
+         if (!(heading in traces)) {
+            traces[heading] = data.length
+            data.push({
+               name: heading,
+               type: 'scatter',
+               mode: 'lines',
+               hoverlabel: {namelength: 80},
+               x: [], y: [],
+               yaxis: (heading[0] == '%') ? 'y2' : 'y1',
+               visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
+            })
 
-      subtree.appendChild(button(heading, true))
-      totals.push(0)
+            subtree.appendChild(button(heading, true))
+            totals.push(0)
+         }
+
+         return traces[heading]
+      })
    }
 
+   setColumns(json[1])
+
    const container = document.querySelector('#events')
    container.appendChild(subtree)
 
    const timeOffset = json[2][0]
+   let samples = 0
+   let lastTime = timeOffset
+
    for (let row = 2; row < json.length; row++) {
       const val = json[row][0]
 
@@ -494,7 +625,7 @@ function parse(file) {
          switch(val) {
          case 'label':
             layout.annotations.push({
-               x: (json[row][1] - timeOffset) / 1e6,
+               x: (json[row][1] - timeOffset) / (tsScale * 1e3),
                y: 0,
                text: json[row][2],
                arrowhead: 3,
@@ -502,6 +633,33 @@ function parse(file) {
                ay: 40
             })
             break;
+         case 'columns':
+            // later samples have different columns; mark where
+            setColumns(json[row][2])
+            layout.annotations.push({
+               x: (json[row][1] - timeOffset) / (tsScale * 1e3),
+               y: 0,
+               text: 'columns changed',
+               arrowhead: 3,
+               ax: 0,
+               ay: 40
+            })
+            break;
+         case 'gap': {
+            // samples were late; break the lines rather than joining across the gap
+            const from = new Date((json[row][1] + tsOrigin) / tsScale)
+
+            for (const trace of data) {
+               trace.x.push(from)
+               trace.y.push(null)
+            }
+            break;
+         }
+         case 'end':
+            // written on clean close; 'numascope verify' also checks the checksum
+            if (json[row][1] != samples)
+               alert('File has '+samples+' samples, but '+json[row][1]+' were recorded')
+            break;
          default:
             alert('unknown op '+val)
          }
@@ -509,31 +667,31 @@ function parse(file) {
          continue
       }
 
-      const time = new Date(val / 1e3)
+      samples++
+      lastTime = val
+
+      const time = new Date((val + tsOrigin) / tsScale)
       const elems = reduce(json[row].slice(1, json[row].length))
 
-      for (let elem = 0; elem < elems.length; elem++) {
-         data[elem].x.push(time)
-         data[elem].y.push(
+      for (let elem = 0; elem < elems.length && elem < columns.length; elem++) {
+         const trace = columns[elem]
+         data[trace].x.push(time)
+         data[trace].y.push(
             (headings[elem][0] == '%') ? (elems[elem] / normalise) : elems[elem])
-         totals[elem] += elems[elem]
+         totals[trace] += elems[elem]
       }
    }
 
    const totalsTable = document.getElementById('totals')
-   const interval = (json[json.length-1][0] - json[2][0]) / 1e6
+   const interval = (lastTime - timeOffset) / (tsScale * 1e3)
    document.getElementById('tableCaption').innerHTML = 'Total time '+interval.toFixed(2)+'s'
-   let i = 0
-
-   for (const heading of headings) {
+   for (let i = 0; i < data.length; i++) {
       const row = totalsTable.insertRow(-1)
       const cell = row.insertCell(-1)
 
-      cell.innerHTML = heading
+      cell.innerHTML = data[i].name
       row.insertCell(-1).innerHTML = totals[i]
       row.insertCell(-1).innerHTML = Math.round(totals[i]/interval)
-
-      i++
    }
 
    layout.xaxis.autorange = true
@@ -0,0 +1,161 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "crypto/rand"
+   "encoding/hex"
+   "sync"
+   "time"
+)
+
+// per-connection settings kept after a client disconnects, so it can resume them
+type session struct {
+   interval int
+   digits   int
+   stopped  bool
+   last     int64 // timestamp of the last epoch sent
+   expires  time.Time
+}
+
+var (
+   sessions     = map[string]*session{}
+   sessionMutex sync.Mutex
+)
+
+func newSessionID() string {
+   buf := make([]byte, 16)
+   _, err := rand.Read(buf)
+   validate(err)
+
+   return hex.EncodeToString(buf)
+}
+
+// identifies a connection in logs; short enough to quote in a support request
+func newConnID() string {
+   buf := make([]byte, 4)
+   _, err := rand.Read(buf)
+   validate(err)
+
+   return hex.EncodeToString(buf)
+}
+
+// drops sessions idle for too long; sessionMutex must be held
+func expireSessions(now time.Time) {
+   for id, s := range sessions {
+      if now.After(s.expires) {
+         delete(sessions, id)
+      }
+   }
+}
+
+// remembers a disconnecting client's settings
+func saveSession(c *Connection) {
+   if *sessionTimeout <= 0 {
+      return
+   }
+
+   c.mutex.Lock()
+   last, interval, digits := c.last, c.interval, c.digits
+   c.mutex.Unlock()
+
+   sessionMutex.Lock()
+   defer sessionMutex.Unlock()
+
+   now := time.Now()
+   expireSessions(now)
+
+   sessions[c.session] = &session{
+      interval: interval,
+      digits: digits,
+      stopped: c.stopped,
+      last: last,
+      expires: now.Add(*sessionTimeout),
+   }
+}
+
+// applies the settings of an earlier connection, returning false if unknown or expired;
+// c.mutex must be held
+func resumeSession(c *Connection, id string) bool {
+   sessionMutex.Lock()
+   defer sessionMutex.Unlock()
+
+   expireSessions(time.Now())
+
+   s, ok := sessions[id]
+   if !ok {
+      return false
+   }
+
+   delete(sessions, id)
+   c.interval = s.interval
+   if c.interval > 0 && c.interval < minInterval {
+      c.interval = minInterval
+   }
+   c.digits = s.digits
+   c.stopped = s.stopped
+   c.last = s.last
+
+   return true
+}
+
+// sends a resumed client the epochs it missed which are still in the history, from
+// after 'from', the last one its session was sent, until 'until', the first this
+// connection was sent, or now if 0, preceded by a 'backfill' label marking the first
+func (c *Connection) backfill(from, until int64) {
+   if *historyLen <= 0 || from == 0 || c.stopped {
+      return
+   }
+
+   if until == 0 {
+      until = now()
+   }
+
+   // those sampled with other columns can't be sent in the current layout
+   sampling.Lock()
+   columns := headings()
+   var layout []int
+   if *nullColumns {
+      layout = fullLayout(*discrete)
+   }
+   sampling.Unlock()
+
+   var epochs [][]int64
+
+   for _, entry := range recall(from+1, until-1) {
+      if equal(entry.columns, columns) {
+         epochs = append(epochs, entry.values)
+      }
+   }
+
+   // thinned separately so the live data keeps its own pace
+   epochs, _ = thin(epochs, c.period(), from)
+   if len(epochs) == 0 {
+      return
+   }
+
+   err := c.WriteJSON(&LabelMessage{Op: "label", Timestamp: epochs[0][0], Label: "backfill"})
+   if err != nil {
+      c.debugln("broadcast", "failed writing:", err)
+      return
+   }
+
+   c.sendData(epochs, layout)
+   c.logf("info", logFields{"epochs": len(epochs)}, "backfilled %d epochs", len(epochs))
+}
@@ -0,0 +1,96 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "encoding/json"
+   "strings"
+   "sync"
+   "testing"
+   "time"
+)
+
+func TestResumeSession(t *testing.T) {
+   saved := *sessionTimeout
+   *sessionTimeout = time.Minute
+   defer func() {
+      *sessionTimeout = saved
+   }()
+
+   old := &Connection{mutex: &sync.Mutex{}, session: newSessionID(), interval: 250, digits: 3, stopped: true}
+   saveSession(old)
+
+   c := &Connection{mutex: &sync.Mutex{}, session: newSessionID()}
+   if !resumeSession(c, old.session) {
+      t.Fatal("session not found")
+   }
+
+   if c.interval != 250 || c.digits != 3 || !c.stopped {
+      t.Fatalf("got %+v", c)
+   }
+
+   // sessions resume once
+   if resumeSession(&Connection{}, old.session) {
+      t.Fatal("session resumed twice")
+   }
+
+   // and expire
+   saveSession(c)
+   sessions[c.session].expires = time.Now().Add(-time.Second)
+   if resumeSession(&Connection{}, c.session) {
+      t.Fatal("expired session resumed")
+   }
+}
+
+func TestBackfill(t *testing.T) {
+   saved := *historyLen
+   *historyLen = 4
+   defer func() {
+      *historyLen = saved
+      history, historyNext = nil, 0
+   }()
+
+   sensor := newFakeSensor()
+   sensor.events[0].enabled = true
+   present = []Sensor{sensor}
+   resetConnections()
+   defer resetConnections()
+
+   history, historyNext = nil, 0
+   base := now()
+   for i := int64(0); i < 6; i++ {
+      remember(headings(), epochFloats(*discrete), []int64{base + i*1e6, i})
+   }
+
+   // last sent the third sample, and the sixth arrived since reconnecting
+   c, f := fakeConnection()
+   c.interval = 1
+   c.backfill(base + 2*1e6, base + 5*1e6)
+
+   sent := f.sent()
+   if len(sent) != 2 || !strings.Contains(sent[0], `"backfill"`) {
+      t.Fatalf("got %v", sent)
+   }
+
+   var epochs [][]int64
+   err := json.Unmarshal([]byte(sent[1]), &epochs)
+   if err != nil || len(epochs) != 2 || epochs[0][1] != 3 || epochs[1][1] != 4 {
+      t.Fatalf("got %s, %v", sent[1], err)
+   }
+}
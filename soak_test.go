@@ -0,0 +1,218 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "log"
+   "math/rand"
+   "net/http"
+   "net/http/httptest"
+   "runtime"
+   "strconv"
+   "strings"
+   "sync"
+   "testing"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// collects what an http.Server logs, including handler panics it recovers from
+type serverLog struct {
+   mutex sync.Mutex
+   buf   bytes.Buffer
+}
+
+func (l *serverLog) Write(b []byte) (int, error) {
+   l.mutex.Lock()
+   defer l.mutex.Unlock()
+
+   return l.buf.Write(b)
+}
+
+func (l *serverLog) String() string {
+   l.mutex.Lock()
+   defer l.mutex.Unlock()
+
+   return l.buf.String()
+}
+
+// waits for cond to hold, for up to 5s
+func eventually(cond func() bool) bool {
+   for i := 0; i < 500; i++ {
+      if cond() {
+         return true
+      }
+      time.Sleep(10 * time.Millisecond)
+   }
+
+   return false
+}
+
+func heapInUse() uint64 {
+   var stats runtime.MemStats
+
+   runtime.GC()
+   runtime.ReadMemStats(&stats)
+   return stats.HeapInuse
+}
+
+// connects and disconnects clients which change events, interval and averaging while
+// sampling and broadcasting as live() does, checking nothing panics or leaks
+func TestSoak(t *testing.T) {
+   if testing.Short() {
+      t.Skip("soak test")
+   }
+
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+
+   goroutines := runtime.NumGoroutine()
+   heap := heapInUse()
+
+   // net/http recovers handler panics, so they're only seen in its log
+   errors := &serverLog{}
+   server := httptest.NewUnstartedServer(http.HandlerFunc(monitor))
+   server.Config.ErrorLog = log.New(errors, "", 0)
+   server.Start()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   stop := make(chan struct{})
+   var wg sync.WaitGroup
+
+   wg.Add(1)
+   go func() {
+      defer wg.Done()
+
+      for {
+         select {
+         case <-stop:
+            return
+         case <-time.After(time.Millisecond):
+         }
+
+         if columns(*discrete) > 0 {
+            samples, layout := sampleAll(now())
+            broadcastData([][]int64{samples}, layout)
+         }
+      }
+   }()
+
+   ops := []func(r *rand.Rand) map[string]string{
+      func(r *rand.Rand) map[string]string {
+         state := []string{"on", "off"}[r.Intn(2)]
+         return map[string]string{"Op": "update", "Event": "fake event " + strconv.Itoa(r.Intn(3)), "State": state}
+      },
+      func(r *rand.Rand) map[string]string {
+         return map[string]string{"Op": "interval", "Value": strconv.Itoa(minInterval + r.Intn(500))}
+      },
+      func(r *rand.Rand) map[string]string {
+         return map[string]string{"Op": "averaging", "Value": strconv.FormatBool(r.Intn(2) == 0)}
+      },
+   }
+
+   deadline := time.Now().Add(2 * time.Second)
+
+   for w := 0; w < 8; w++ {
+      wg.Add(1)
+
+      go func(seed int64) {
+         defer wg.Done()
+         r := rand.New(rand.NewSource(seed))
+
+         for time.Now().Before(deadline) {
+            client, _, err := websocket.DefaultDialer.Dial(url, nil)
+            if err != nil {
+               t.Error(err)
+               return
+            }
+
+            // drain until closed
+            read := make(chan struct{})
+            go func() {
+               defer close(read)
+
+               for {
+                  _, _, err := client.ReadMessage()
+                  if err != nil {
+                     return
+                  }
+               }
+            }()
+
+            _ = client.WriteMessage(websocket.TextMessage, []byte(*token))
+
+            for i := r.Intn(20); i > 0; i-- {
+               _ = client.WriteJSON(ops[r.Intn(len(ops))](r))
+            }
+
+            // sometimes disconnect abruptly, without a close handshake
+            if r.Intn(2) == 0 {
+               msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+               _ = client.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+            }
+
+            client.Close()
+            <-read
+         }
+      }(int64(w))
+   }
+
+   time.Sleep(time.Until(deadline))
+   close(stop)
+   wg.Wait()
+
+   // clients may have left per-unit values selected
+   client, _, err := websocket.DefaultDialer.Dial(url, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   client.WriteMessage(websocket.TextMessage, []byte(*token))
+   client.WriteJSON(map[string]string{"Op": "averaging", "Value": "true"})
+
+   var change ChangeMessage
+   for change.Op != "enabled" || change.Discrete {
+      err := client.ReadJSON(&change)
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+
+   client.Close()
+
+   if !eventually(func() bool { return len(clients()) == 0 }) {
+      t.Fatalf("%d clients remain registered", len(clients()))
+   }
+
+   server.Close()
+
+   if strings.Contains(errors.String(), "panic") {
+      t.Errorf("handler panicked:\n%s", errors)
+   }
+
+   if !eventually(func() bool { return runtime.NumGoroutine() <= goroutines }) {
+      t.Errorf("%d goroutines before, %d after", goroutines, runtime.NumGoroutine())
+   }
+
+   // allow for caches, but not per-connection state kept forever
+   if after := heapInUse(); after > heap + 16<<20 {
+      t.Errorf("heap grew from %d to %d bytes", heap, after)
+   }
+}
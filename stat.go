@@ -18,19 +18,14 @@
 package main
 
 import (
-   "bytes"
    "fmt"
    "os"
    "strings"
    "time"
-
-   "golang.org/x/sys/unix"
 )
 
 func stat() {
-   if *debug {
-      fmt.Printf("detected %v\n", present)
-   }
+   debugf("sampling", "detected %v\n", present)
 
    if *list {
       for _, sensor := range present {
@@ -44,7 +39,7 @@ func stat() {
       os.Exit(0)
    }
 
-   delay := time.Duration(*interval) * time.Millisecond
+   delay := time.Duration(intervalSetting()) * time.Millisecond
    line := 0
    headings := make([][]string, len(present))
 
@@ -58,11 +53,14 @@ func stat() {
       time.Sleep(delay)
 
       // print any label
-      n, err := unix.Read(fifo, labelBuf)
-      validateNonblock(err)
+      label := pendingLabel(labelBuf)
+
+      if label != "" {
+         fmt.Printf("- %s -\n", label)
+      }
 
-      if n > 0 {
-         fmt.Printf("- %s -\n", bytes.TrimSpace(labelBuf[:n]))
+      for _, l := range channelLabels(labelBuf) {
+         fmt.Printf("- %s: %s -\n", l.channel, l.label)
       }
 
       // print column headings
@@ -77,11 +75,16 @@ func stat() {
 
       for i, sensor := range present {
          samples := sensor.Sample()
+         floats := sensorFloats(sensor, *discrete)
 
          for j, heading := range headings[i] {
-            fmt.Printf("%*d ", len(heading), samples[j])
+            fmt.Printf("%*s ", len(heading), appendSample(nil, samples[j], floatAt(floats, j), 0, false))
          }
       }
       fmt.Println()
+
+      for _, name := range takeResets() {
+         fmt.Printf("- %s counter reset -\n", name)
+      }
    }
 }
@@ -0,0 +1,183 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "errors"
+   "net/http"
+   "strings"
+   "sync"
+   "sync/atomic"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// carries the messages a websocket client would receive as newline-delimited JSON
+// over a plain HTTP response, for consumers such as curl; nothing is read
+type streamTransport struct {
+   w       http.ResponseWriter
+   rc      *http.ResponseController
+   mutex   sync.Mutex // serialises writes; may be held while a write blocks
+   closed  int32 // accessed atomically, so closing never waits for a write
+   done    <-chan struct{} // the client went away
+   closing chan struct{}
+   ctl     sync.Mutex // never held while blocking; guards ended
+   ended   bool // the handler returned, so rc can't be used
+}
+
+var errStreamClosed = errors.New("stream closed")
+
+func newStreamTransport(w http.ResponseWriter, r *http.Request) *streamTransport {
+   return &streamTransport{
+      w:       w,
+      rc:      http.NewResponseController(w),
+      done:    r.Context().Done(),
+      closing: make(chan struct{}),
+   }
+}
+
+// blocks until the client disconnects or the stream is closed
+func (s *streamTransport) ReadMessage() (int, []byte, error) {
+   select {
+   case <-s.done:
+   case <-s.closing:
+   }
+
+   return 0, nil, errStreamClosed
+}
+
+func (s *streamTransport) WriteMessage(messageType int, data []byte) error {
+   s.mutex.Lock()
+   defer s.mutex.Unlock()
+
+   // set before checking closed, so a Close() racing with this can't be undone
+   if *writeStall > 0 {
+      _ = s.rc.SetWriteDeadline(time.Now().Add(*writeStall))
+   }
+
+   if atomic.LoadInt32(&s.closed) != 0 {
+      return errStreamClosed
+   }
+
+   _, err := s.w.Write(data)
+   if err == nil {
+      _, err = s.w.Write([]byte{'\n'})
+   }
+
+   if err == nil {
+      err = s.rc.Flush()
+   }
+
+   // a partial line would corrupt the stream
+   if err != nil {
+      s.Close()
+   }
+
+   return err
+}
+
+// there are no control frames, so closing just ends the response
+func (s *streamTransport) WriteControl(messageType int, data []byte, deadline time.Time) error {
+   if messageType == websocket.CloseMessage {
+      return s.Close()
+   }
+
+   return nil
+}
+
+func (s *streamTransport) EnableWriteCompression(enable bool) {}
+
+func (s *streamTransport) SetWriteDeadline(t time.Time) error {
+   return s.rc.SetWriteDeadline(t)
+}
+
+// ends the stream without waiting for a blocked write, which it fails
+func (s *streamTransport) Close() error {
+   if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+      return nil
+   }
+
+   s.ctl.Lock()
+   if !s.ended {
+      _ = s.rc.SetWriteDeadline(time.Now())
+   }
+   s.ctl.Unlock()
+
+   close(s.closing)
+   return nil
+}
+
+// called as the handler returns: closes the stream and waits for any write, which
+// can't touch the response after
+func (s *streamTransport) finish() {
+   s.Close()
+
+   s.mutex.Lock()
+   s.mutex.Unlock()
+
+   s.ctl.Lock()
+   s.ended = true
+   s.ctl.Unlock()
+}
+
+// ends streams when the server shuts down, which otherwise waits for their handlers
+func closeStreams() {
+   for _, c := range clients() {
+      if s, ok := c.socket.(*streamTransport); ok {
+         s.Close()
+      }
+   }
+}
+
+// sends the signon, change, data, label and heartbeat messages as a websocket
+// client receives them, one per line, for as long as the client stays connected
+func stream(w http.ResponseWriter, r *http.Request) {
+   if !authorized(r) {
+      authFailed(r.RemoteAddr)
+      w.Header().Set("WWW-Authenticate", "Bearer")
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   presented, _ := bearer(r)
+   c := Connection{mutex: &sync.Mutex{}, addr: r.RemoteAddr, session: newSessionID(), id: newConnID(), maxFailures: *maxWriteFailures}
+
+   if !c.reserve() {
+      w.Header().Set("Retry-After", "30")
+      http.Error(w, "too many connections", http.StatusServiceUnavailable)
+      return
+   }
+   defer c.unreserve()
+
+   s := newStreamTransport(w, r)
+   defer s.finish()
+
+   // the server's read timeout would otherwise end the stream
+   _ = s.rc.SetReadDeadline(time.Time{})
+
+   w.Header().Set("Content-Type", "application/x-ndjson")
+   w.Header().Set("Cache-Control", "no-cache")
+   w.WriteHeader(http.StatusOK)
+
+   c.socket = s
+   c.spectator = !tokenMatches(presented, currentToken())
+   c.handshakeFlags(strings.Fields(r.URL.Query().Get("flags")))
+
+   serve(&c)
+}
@@ -0,0 +1,153 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "encoding/json"
+   "errors"
+   "net/http"
+   "net/http/httptest"
+   "sync"
+   "sync/atomic"
+   "testing"
+   "time"
+)
+
+func TestStream(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   server := testServer(t, stream)
+   defer server.Close()
+
+   resp, err := http.Get(server.URL)
+   if err != nil {
+      t.Fatal(err)
+   }
+   resp.Body.Close()
+
+   if resp.StatusCode != http.StatusUnauthorized {
+      t.Fatalf("got status %d without token", resp.StatusCode)
+   }
+
+   req, _ := http.NewRequest("GET", server.URL+"?flags=verbose", nil)
+   req.Header.Set("Authorization", "Bearer "+*token)
+
+   resp, err = http.DefaultClient.Do(req)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   lines := bufio.NewScanner(resp.Body)
+
+   var signon SignonMessage
+   if !lines.Scan() || json.Unmarshal(lines.Bytes(), &signon) != nil || signon.Version != protocolVersion || !signon.Verbose {
+      t.Fatalf("got signon %s", lines.Bytes())
+   }
+
+   var change ChangeMessage
+   if !lines.Scan() || json.Unmarshal(lines.Bytes(), &change) != nil || change.Op != "enabled" {
+      t.Fatalf("got change %s", lines.Bytes())
+   }
+
+   broadcastLabel(now(), "", "streamed")
+
+   var label LabelMessage
+   if !lines.Scan() || json.Unmarshal(lines.Bytes(), &label) != nil || label.Label != "streamed" {
+      t.Fatalf("got label %s", lines.Bytes())
+   }
+
+   // the connection is dropped once the client goes away
+   resp.Body.Close()
+   if !eventually(func() bool { return len(clients()) == 0 }) {
+      t.Fatal("stream still connected")
+   }
+}
+
+// a response whose client stopped reading: writes block until the deadline passes
+type wedgedResponse struct {
+   *httptest.ResponseRecorder
+   mutex    sync.Mutex
+   deadline time.Time
+   expired  chan struct{}
+}
+
+func (w *wedgedResponse) Write(b []byte) (int, error) {
+   <-w.expired
+   return 0, errors.New("i/o timeout")
+}
+
+func (w *wedgedResponse) SetWriteDeadline(t time.Time) error {
+   w.mutex.Lock()
+   defer w.mutex.Unlock()
+
+   if !t.IsZero() && !t.After(time.Now()) && w.deadline.IsZero() {
+      w.deadline = t
+      close(w.expired)
+   }
+
+   return nil
+}
+
+func TestStreamWedged(t *testing.T) {
+   resetConnections()
+   defer resetConnections()
+
+   w := &wedgedResponse{ResponseRecorder: httptest.NewRecorder(), expired: make(chan struct{})}
+   s := newStreamTransport(w, httptest.NewRequest("GET", "/stream", nil))
+   c := &Connection{socket: s, mutex: &sync.Mutex{}, id: newConnID()}
+
+   connMutex.Lock()
+   connections = append(connections, c)
+   connMutex.Unlock()
+
+   result := make(chan error)
+   go func() {
+      result <- c.write([]byte("{}"))
+   }()
+
+   if !eventually(func() bool { return atomic.LoadInt64(&c.writing) != 0 }) {
+      t.Fatal("write didn't start")
+   }
+
+   // closing mustn't wait for the blocked write
+   closed := make(chan int)
+   go func() {
+      closed <- closeStalled(time.Now().Add(*writeStall))
+   }()
+
+   select {
+   case n := <-closed:
+      if n != 1 {
+         t.Fatalf("closed %d connections", n)
+      }
+   case <-time.After(time.Second):
+      t.Fatal("watchdog blocked closing the stream")
+   }
+
+   select {
+   case err := <-result:
+      if err == nil {
+         t.Fatal("write succeeded on a wedged stream")
+      }
+   case <-time.After(time.Second):
+      t.Fatal("write still blocked after closing")
+   }
+
+   s.finish()
+}
@@ -0,0 +1,139 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "net/http"
+   "sync"
+)
+
+// rolling statistics of an event's values over the summary window
+
+type summaryPoint struct {
+   timestamp int64
+   value     float64
+}
+
+type Summary struct {
+   Min     float64
+   Max     float64
+   Avg     float64
+   Samples int
+}
+
+type SummaryMessage struct {
+   Op     string
+   Window int64 // ms
+   Events map[string]Summary // keyed by column heading
+}
+
+var (
+   summaryPoints = map[string][]summaryPoint{} // recent values of each column, oldest first
+   summaryMutex  sync.Mutex
+)
+
+// adds a sample to the window, dropping values which aged out and events which
+// were disabled, so re-enabling them starts afresh
+func summarise(columns []string, floats []bool, samples []int64) {
+   summaryMutex.Lock()
+   defer summaryMutex.Unlock()
+
+   oldest := samples[0] - int64(*summaryWindow) / timeUnit()
+   present := make(map[string]bool, len(columns))
+
+   for i, name := range columns {
+      present[name] = true
+      value := float64(samples[i+1])
+      if floatAt(floats, i+1) {
+         value /= floatScale
+      }
+
+      points := append(summaryPoints[name], summaryPoint{samples[0], value})
+
+      expired := 0
+      for expired < len(points) && points[expired].timestamp < oldest {
+         expired++
+      }
+
+      summaryPoints[name] = points[expired:]
+   }
+
+   for name := range summaryPoints {
+      if !present[name] {
+         delete(summaryPoints, name)
+      }
+   }
+}
+
+// forgets all values, eg after the sensors are re-baselined
+func resetSummaries() {
+   summaryMutex.Lock()
+   summaryPoints = map[string][]summaryPoint{}
+   summaryMutex.Unlock()
+}
+
+// minimum, maximum and mean of each event over the window
+func summaries() SummaryMessage {
+   summaryMutex.Lock()
+   defer summaryMutex.Unlock()
+
+   msg := SummaryMessage{
+      Op: "summary",
+      Window: summaryWindow.Milliseconds(),
+      Events: make(map[string]Summary, len(summaryPoints)),
+   }
+
+   for name, points := range summaryPoints {
+      if len(points) == 0 {
+         continue
+      }
+
+      s := Summary{Min: points[0].value, Max: points[0].value, Samples: len(points)}
+      total := 0.0
+
+      for _, point := range points {
+         if point.value < s.Min {
+            s.Min = point.value
+         }
+         if point.value > s.Max {
+            s.Max = point.value
+         }
+         total += point.value
+      }
+
+      s.Avg = total / float64(len(points))
+      msg.Events[name] = s
+   }
+
+   return msg
+}
+
+// serves the summary to monitoring without a websocket
+func summaryEndpoint(w http.ResponseWriter, r *http.Request) {
+   if !authorized(r) {
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   if *summaryWindow <= 0 {
+      http.Error(w, "summaries disabled; see -summary-window", http.StatusNotFound)
+      return
+   }
+
+   grafanaJSON(w, summaries())
+}
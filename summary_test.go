@@ -0,0 +1,67 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "net/http/httptest"
+   "testing"
+   "time"
+)
+
+func TestSummaries(t *testing.T) {
+   saved := *summaryWindow
+   *summaryWindow = 3 * time.Second
+   defer func() {
+      *summaryWindow = saved
+   }()
+
+   resetSummaries()
+   unit := int64(time.Second) / timeUnit()
+
+   // the first sample of 'a' ages out of the window
+   for i := int64(1); i <= 5; i++ {
+      summarise([]string{"a", "b"}, []bool{false, false, true}, []int64{i * unit, i * 10, i * floatScale / 2})
+   }
+
+   req := httptest.NewRequest("GET", "/summary", nil)
+   req.Header.Set("Authorization", "Bearer "+*token)
+   w := httptest.NewRecorder()
+   summaryEndpoint(w, req)
+
+   var msg SummaryMessage
+   err := json.Unmarshal(w.Body.Bytes(), &msg)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   want := Summary{Min: 20, Max: 50, Avg: 35, Samples: 4}
+   if msg.Window != 3000 || msg.Events["a"] != want {
+      t.Fatalf("got %+v; want a %+v", msg, want)
+   }
+
+   if b := msg.Events["b"]; b.Min != 1 || b.Max != 2.5 {
+      t.Fatalf("got b %+v", b)
+   }
+
+   // disabling 'b' forgets it
+   summarise([]string{"a"}, nil, []int64{6 * unit, 60})
+   if _, ok := summaries().Events["b"]; ok {
+      t.Fatal("disabled event still summarised")
+   }
+}
@@ -0,0 +1,65 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "fmt"
+   "net/http"
+   "os"
+   "sync/atomic"
+)
+
+// logs a frame to stderr if tracing was enabled for this connection
+func (c *Connection) trace(format string, args ...interface{}) {
+   if atomic.LoadInt32(&c.tracing) != 0 {
+      fields, msg := c.fields(nil, fmt.Sprintf(format, args...))
+      logTo(os.Stderr, "debug", fields, msg)
+   }
+}
+
+// turns frame tracing on or off for the client with the address or connection ID given,
+// as listed by /healthz
+func traceClient(w http.ResponseWriter, r *http.Request) {
+   if !hasBearer(r, currentToken()) {
+      http.Error(w, "unauthorized", http.StatusUnauthorized)
+      return
+   }
+
+   addr := r.FormValue("client")
+   var on int32
+
+   switch r.FormValue("state") {
+   case "on":
+      on = 1
+   case "off":
+   default:
+      http.Error(w, "state must be on or off", http.StatusBadRequest)
+      return
+   }
+
+   for _, c := range clients() {
+      if c.addr == addr || c.id == addr {
+         atomic.StoreInt32(&c.tracing, on)
+         fmt.Fprintf(w, "tracing %s %s\n", addr, r.FormValue("state"))
+         return
+      }
+   }
+
+   http.Error(w, "no client "+addr, http.StatusNotFound)
+}
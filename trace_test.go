@@ -0,0 +1,55 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+   "net/http"
+   "net/http/httptest"
+   "net/url"
+   "sync/atomic"
+   "testing"
+)
+
+func TestTraceClient(t *testing.T) {
+   _, done := dial(t)
+   defer done()
+
+   c := clients()[0]
+
+   for _, tc := range []struct {
+      auth  string
+      state string
+      code  int
+      want  int32
+   }{
+      {"", "on", http.StatusUnauthorized, 0},
+      {"Bearer " + *token, "maybe", http.StatusBadRequest, 0},
+      {"Bearer " + *token, "on", http.StatusOK, 1},
+      {"Bearer " + *token, "off", http.StatusOK, 0},
+   } {
+      r := httptest.NewRequest("POST", "/trace?client="+url.QueryEscape(c.addr)+"&state="+tc.state, nil)
+      r.Header.Set("Authorization", tc.auth)
+      w := httptest.NewRecorder()
+      traceClient(w, r)
+
+      if w.Code != tc.code || atomic.LoadInt32(&c.tracing) != tc.want {
+         t.Fatalf("%+v: got status %d, tracing %d", tc, w.Code, c.tracing)
+      }
+   }
+}
@@ -0,0 +1,318 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "errors"
+   "fmt"
+   "io"
+   "strings"
+   "sync"
+   "sync/atomic"
+   "testing"
+   "time"
+)
+
+// an in-memory transport recording what is written
+type fakeTransport struct {
+   mutex    sync.Mutex
+   messages []string
+   failing  bool // writes fail
+   closed   bool
+   wedged   chan struct{} // if set, writes block until closed
+}
+
+func (f *fakeTransport) ReadMessage() (int, []byte, error) {
+   return 0, nil, io.EOF
+}
+
+func (f *fakeTransport) WriteMessage(messageType int, data []byte) error {
+   if f.wedged != nil {
+      <-f.wedged
+   }
+
+   f.mutex.Lock()
+   defer f.mutex.Unlock()
+
+   if f.failing || f.closed {
+      return errors.New("write failed")
+   }
+
+   f.messages = append(f.messages, string(data))
+   return nil
+}
+
+func (f *fakeTransport) WriteControl(messageType int, data []byte, deadline time.Time) error {
+   return nil
+}
+
+func (f *fakeTransport) EnableWriteCompression(enable bool) {}
+
+func (f *fakeTransport) SetWriteDeadline(t time.Time) error {
+   return nil
+}
+
+func (f *fakeTransport) Close() error {
+   f.mutex.Lock()
+   if f.wedged != nil && !f.closed {
+      close(f.wedged)
+   }
+   f.closed = true
+   f.mutex.Unlock()
+   return nil
+}
+
+func (f *fakeTransport) sent() []string {
+   f.mutex.Lock()
+   defer f.mutex.Unlock()
+
+   return append([]string(nil), f.messages...)
+}
+
+// registers a connection over a fake transport
+func fakeConnection() (*Connection, *fakeTransport) {
+   f := &fakeTransport{}
+   c := &Connection{socket: f, mutex: &sync.Mutex{}, id: newConnID()}
+
+   connMutex.Lock()
+   connections = append(connections, c)
+   connMutex.Unlock()
+
+   return c, f
+}
+
+func TestBroadcastSkipsStopped(t *testing.T) {
+   sensor := newFakeSensor()
+   sensor.events[0].enabled = true
+   present = []Sensor{sensor}
+   resetConnections()
+
+   _, active := fakeConnection()
+   stopped, idle := fakeConnection()
+   stopped.stopped = true
+
+   broadcastData([][]int64{{now(), 1}}, nil)
+
+   if got := active.sent(); len(got) != 1 || got[0][:2] != "[[" {
+      t.Fatalf("active client got %q", got)
+   }
+
+   if got := idle.sent(); len(got) != 0 {
+      t.Fatalf("stopped client got %q", got)
+   }
+
+   // labels still reach stopped clients
+   broadcastLabel(now(), "", "phase")
+
+   if len(active.sent()) != 2 || len(idle.sent()) != 1 {
+      t.Fatalf("got %q and %q", active.sent(), idle.sent())
+   }
+}
+
+func TestWriteFailuresDrop(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+
+   c, f := fakeConnection()
+   c.maxFailures = 3
+   f.failing = true
+
+   for i := 0; i < 2; i++ {
+      broadcastLabel(now(), "", "lost")
+   }
+
+   if f.closed {
+      t.Fatal("closed before reaching the limit")
+   }
+
+   broadcastLabel(now(), "", "lost")
+
+   if !f.closed || c.failed != 3 {
+      t.Fatalf("closed %v after %d failures", f.closed, c.failed)
+   }
+}
+
+func TestLazyDue(t *testing.T) {
+   resetConnections()
+   fast, _ := fakeConnection()
+   fast.interval = 100
+   slow, _ := fakeConnection()
+   slow.interval = 300
+   defer resetConnections()
+
+   start := time.Now()
+   if nextDue(start) != 0 || !takeDue(start) {
+      t.Fatal("new clients should be due immediately")
+   }
+
+   if takeDue(start.Add(50 * time.Millisecond)) {
+      t.Fatal("no client should be due after 50ms")
+   }
+
+   if wait := nextDue(start.Add(50 * time.Millisecond)); wait != 50*time.Millisecond {
+      t.Fatalf("waiting %v, want 50ms", wait)
+   }
+
+   // only the faster client's timer fires
+   if !takeDue(start.Add(100 * time.Millisecond)) || !slow.due.Equal(start.Add(300 * time.Millisecond)) {
+      t.Fatalf("slow client due at %v", slow.due.Sub(start))
+   }
+
+   resetConnections()
+   if takeDue(start) {
+      t.Fatal("no sampling without clients")
+   }
+}
+
+func TestCloseStalled(t *testing.T) {
+   resetConnections()
+   defer resetConnections()
+
+   c, f := fakeConnection()
+   f.wedged = make(chan struct{})
+
+   result := make(chan error)
+   go func() {
+      result <- c.write([]byte("stuck"))
+   }()
+
+   if !eventually(func() bool { return atomic.LoadInt64(&c.writing) != 0 }) {
+      t.Fatal("write didn't start")
+   }
+
+   if closeStalled(time.Now()) != 0 {
+      t.Fatal("closed a write which just began")
+   }
+
+   before := atomic.LoadUint64(&forcedCloses)
+   if closeStalled(time.Now().Add(*writeStall)) != 1 {
+      t.Fatal("stalled write not closed")
+   }
+
+   if err := <-result; err == nil {
+      t.Fatal("write succeeded on a closed socket")
+   }
+
+   if atomic.LoadUint64(&forcedCloses) != before+1 {
+      t.Fatal("forced close not counted")
+   }
+}
+
+func TestWriteFailuresConsecutive(t *testing.T) {
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   defer resetConnections()
+
+   c, f := fakeConnection()
+   c.maxFailures = 2
+
+   // a successful write in between restarts the count
+   for _, failing := range []bool{true, false, true} {
+      f.failing = failing
+      broadcastLabel(now(), "", "lost")
+   }
+
+   if f.closed || c.failed != 2 {
+      t.Fatalf("closed %v after %d failures", f.closed, c.failed)
+   }
+
+   broadcastLabel(now(), "", "lost")
+   if !f.closed {
+      t.Fatal("not closed after consecutive failures")
+   }
+
+   // or never, with a limit of 0
+   _, f = fakeConnection()
+   f.failing = true
+
+   for i := 0; i < 5; i++ {
+      broadcastLabel(now(), "", "lost")
+   }
+
+   if f.closed {
+      t.Fatal("closed without a limit")
+   }
+}
+
+func TestLabelFlushesBatch(t *testing.T) {
+   saved := *coalescing
+   *coalescing = 60000
+   defer func() { *coalescing = saved }()
+
+   sensor := newFakeSensor()
+   sensor.events[0].enabled = true
+   present = []Sensor{sensor}
+   resetConnections()
+   defer resetConnections()
+
+   c, f := fakeConnection()
+   c.interval = 1
+
+   // within the coalescing window, so held back
+   first := now()
+   batchSent = first
+   coalesce([]int64{first, 1}, nil)
+   if len(f.sent()) != 0 {
+      t.Fatal("sample sent before the window ended")
+   }
+
+   broadcastLabel(first+1, "", "phase 1")
+
+   sent := f.sent()
+   if len(sent) != 2 || !strings.HasPrefix(sent[0], "[[") || !strings.Contains(sent[1], "phase 1") {
+      t.Fatalf("got %v; want the sample, then the label", sent)
+   }
+
+   if batched() != 0 {
+      t.Fatal("sample still batched")
+   }
+}
+
+func TestLayoutFlushesBatch(t *testing.T) {
+   saved := *coalescing
+   *coalescing = 60000
+   defer func() { *coalescing = saved }()
+
+   present = []Sensor{newFakeSensor()}
+   resetConnections()
+   defer resetConnections()
+
+   c, f := fakeConnection()
+   c.interval = 1
+
+   first := now()
+   batchSent = first
+   coalesce([]int64{first, 1}, []int{0, 1, -1})
+   if len(f.sent()) != 0 {
+      t.Fatal("sample sent before the window ended")
+   }
+
+   // an event was enabled since, so the batch is sent in the layout it was taken with
+   coalesce([]int64{first+1, 2, 3}, []int{0, 1, 2})
+
+   sent := f.sent()
+   if len(sent) != 1 || sent[0] != fmt.Sprintf("[[%d,1,null]]", first) {
+      t.Fatalf("got %v", sent)
+   }
+
+   if batched() != 1 {
+      t.Fatal("new sample not batched")
+   }
+
+   batch, batchLayout = nil, nil
+}